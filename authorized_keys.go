@@ -0,0 +1,163 @@
+package handy_sshd
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+	"time"
+)
+
+// PermissionsFromAuthorizedKeyOptions converts options of a key in OpenSSH authorized_keys into ssh.Permissions which Server honors.
+// An error is returned when the key can not be used from remoteAddr, has expired or has an unsupported option.
+// (ref: https://man.openbsd.org/sshd#AUTHORIZED_KEYS_FILE_FORMAT)
+func PermissionsFromAuthorizedKeyOptions(options []string, remoteAddr net.Addr) (*ssh.Permissions, error) {
+	noPty := false
+	noPortForwarding := false
+	var forceCommand string
+	var permitOpen []string
+	var permitListen []string
+	var environment []string
+	var expiryTime time.Time
+	for _, option := range options {
+		name, value, hasValue := strings.Cut(option, "=")
+		name = strings.ToLower(name)
+		if hasValue {
+			value = unquoteAuthorizedKeyOptionValue(value)
+		}
+		switch name {
+		case "restrict":
+			noPty = true
+			noPortForwarding = true
+		case "no-pty":
+			noPty = true
+		case "pty":
+			noPty = false
+		case "no-port-forwarding":
+			noPortForwarding = true
+		case "port-forwarding":
+			noPortForwarding = false
+		case "command":
+			forceCommand = value
+		case "from":
+			if err := MatchFrom(value, remoteAddr); err != nil {
+				return nil, err
+			}
+		case "permitopen":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return nil, errors.Errorf("invalid permitopen: %s", value)
+			}
+			permitOpen = append(permitOpen, value)
+		case "permitlisten":
+			// Listen address without host means any host
+			if !strings.Contains(value, ":") {
+				value = "*:" + value
+			}
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return nil, errors.Errorf("invalid permitlisten: %s", value)
+			}
+			permitListen = append(permitListen, value)
+		case "environment":
+			if !strings.Contains(value, "=") {
+				return nil, errors.Errorf("invalid environment: %s", value)
+			}
+			environment = append(environment, value)
+		case "expiry-time":
+			t, err := parseExpiryTime(value)
+			if err != nil {
+				return nil, err
+			}
+			if time.Now().After(t) {
+				return nil, errors.Errorf("key expired at %s", t)
+			}
+			expiryTime = t
+		// Features handy-sshd does not have
+		case "no-agent-forwarding", "agent-forwarding", "no-x11-forwarding", "x11-forwarding", "no-user-rc", "user-rc", "no-touch-required", "verify-required":
+		default:
+			return nil, errors.Errorf("unsupported option: %s", option)
+		}
+	}
+	permissions := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	if forceCommand != "" {
+		permissions.CriticalOptions[CriticalOptionForceCommand] = forceCommand
+	}
+	if noPty {
+		permissions.Extensions[ExtensionNoPty] = ""
+	}
+	if noPortForwarding {
+		permissions.Extensions[ExtensionNoPortForwarding] = ""
+	}
+	if len(permitOpen) != 0 {
+		permissions.Extensions[ExtensionPermitOpen] = strings.Join(permitOpen, "\n")
+	}
+	if len(permitListen) != 0 {
+		permissions.Extensions[ExtensionPermitListen] = strings.Join(permitListen, "\n")
+	}
+	if len(environment) != 0 {
+		permissions.Extensions[ExtensionEnvironment] = strings.Join(environment, "\n")
+	}
+	if !expiryTime.IsZero() {
+		permissions.Extensions[ExtensionExpiryTime] = expiryTime.Format(time.RFC3339)
+	}
+	return permissions, nil
+}
+
+// unquoteAuthorizedKeyOptionValue removes the surrounding double quotes. Only escaped double quotes are unescaped in the same way as OpenSSH.
+func unquoteAuthorizedKeyOptionValue(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		value = value[1 : len(value)-1]
+	}
+	return strings.ReplaceAll(value, `\"`, `"`)
+}
+
+// MatchFrom checks the remote address with comma-separated patterns in the format of from="..." option of authorized_keys.
+// A pattern is an IP address with wildcards, a CIDR address or one of them negated by "!". Host names are not resolved.
+func MatchFrom(patterns string, remoteAddr net.Addr) error {
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return errors.Errorf("remote address %v is not a TCP address", remoteAddr)
+	}
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		var patternMatched bool
+		if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+			patternMatched = ipNet.Contains(tcpAddr.IP)
+		} else {
+			patternMatched = matchPattern(strings.ToLower(pattern), tcpAddr.IP.String())
+		}
+		if patternMatched && negated {
+			return errors.Errorf("remote address %v is denied by from=%q", remoteAddr, patterns)
+		}
+		matched = matched || patternMatched
+	}
+	if !matched {
+		return errors.Errorf("remote address %v is not allowed by from=%q", remoteAddr, patterns)
+	}
+	return nil
+}
+
+// parseExpiryTime parses YYYYMMDD[Z] or YYYYMMDDHHMM[SS][Z]. The time is local time unless suffixed by "Z".
+func parseExpiryTime(value string) (time.Time, error) {
+	location := time.Local
+	if strings.HasSuffix(value, "Z") || strings.HasSuffix(value, "z") {
+		location = time.UTC
+		value = value[:len(value)-1]
+	}
+	var layout string
+	switch len(value) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, errors.Errorf("invalid expiry-time: %s", value)
+	}
+	return time.ParseInLocation(layout, value, location)
+}
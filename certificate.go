@@ -0,0 +1,24 @@
+package handy_sshd
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// PermissionsFromCertificate converts critical options and extensions of an OpenSSH user certificate into ssh.Permissions which Server honors.
+// Features not listed in extensions (e.g. "permit-pty") are not allowed in the same way as OpenSSH.
+func PermissionsFromCertificate(cert *ssh.Certificate) *ssh.Permissions {
+	permissions := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	for name, value := range cert.CriticalOptions {
+		permissions.CriticalOptions[name] = value
+	}
+	if _, ok := cert.Extensions["permit-pty"]; !ok {
+		permissions.Extensions[ExtensionNoPty] = ""
+	}
+	if _, ok := cert.Extensions["permit-port-forwarding"]; !ok {
+		permissions.Extensions[ExtensionNoPortForwarding] = ""
+	}
+	return permissions
+}
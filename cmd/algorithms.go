@@ -0,0 +1,322 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slices"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Algorithms supported by the server of golang.org/x/crypto/ssh
+var (
+	supportedKexAlgorithms = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	}
+	supportedCiphers = []string{
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"arcfour256", "arcfour128", "arcfour",
+		"aes128-cbc", "3des-cbc",
+	}
+	supportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512",
+		"hmac-sha1", "hmac-sha1-96",
+	}
+	supportedHostKeyAlgorithms = []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+		ssh.KeyAlgoDSA,
+		ssh.CertAlgoED25519v01,
+		ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+		ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01,
+		ssh.CertAlgoDSAv01,
+	}
+)
+
+// Ciphers with their own authentication not using MACs
+var aeadCiphers = []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com"}
+
+// Certificate algorithms by signature algorithms
+var certAlgorithms = map[string]string{
+	ssh.KeyAlgoED25519:   ssh.CertAlgoED25519v01,
+	ssh.KeyAlgoECDSA256:  ssh.CertAlgoECDSA256v01,
+	ssh.KeyAlgoECDSA384:  ssh.CertAlgoECDSA384v01,
+	ssh.KeyAlgoECDSA521:  ssh.CertAlgoECDSA521v01,
+	ssh.KeyAlgoRSASHA512: ssh.CertAlgoRSASHA512v01,
+	ssh.KeyAlgoRSASHA256: ssh.CertAlgoRSASHA256v01,
+	ssh.KeyAlgoRSA:       ssh.CertAlgoRSAv01,
+	ssh.KeyAlgoDSA:       ssh.CertAlgoDSAv01,
+}
+
+type algorithmsPreset struct {
+	kexAlgorithms     []string
+	ciphers           []string
+	macs              []string
+	hostKeyAlgorithms []string
+}
+
+var algorithmsPresets = map[string]algorithmsPreset{
+	// Algorithms without SHA-1 and CBC preferred by recent OpenSSH
+	"modern": {
+		kexAlgorithms: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group16-sha512", "diffie-hellman-group14-sha256",
+		},
+		ciphers: []string{
+			"chacha20-poly1305@openssh.com",
+			"aes256-gcm@openssh.com", "aes128-gcm@openssh.com",
+			"aes256-ctr", "aes192-ctr", "aes128-ctr",
+		},
+		macs: []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com"},
+		hostKeyAlgorithms: []string{
+			ssh.KeyAlgoED25519,
+			ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+			ssh.CertAlgoED25519v01,
+			ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+			ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+		},
+	},
+	// All supported algorithms for old clients
+	"compat": {
+		kexAlgorithms:     supportedKexAlgorithms,
+		ciphers:           supportedCiphers,
+		macs:              supportedMACs,
+		hostKeyAlgorithms: supportedHostKeyAlgorithms,
+	},
+	// Algorithms approved by FIPS 140 (NIST curves, AES and SHA-2)
+	"fips": {
+		kexAlgorithms: []string{
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group16-sha512", "diffie-hellman-group14-sha256",
+		},
+		ciphers: []string{
+			"aes256-gcm@openssh.com", "aes128-gcm@openssh.com",
+			"aes256-ctr", "aes192-ctr", "aes128-ctr",
+		},
+		macs: []string{
+			"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+			"hmac-sha2-256", "hmac-sha2-512",
+		},
+		hostKeyAlgorithms: []string{
+			ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+			ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+			ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+		},
+	},
+}
+
+func algorithmsPresetNames() []string {
+	var names []string
+	for name := range algorithmsPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateAlgorithms returns an error when an algorithm is not supported. flagName is used in the error message (e.g. "--ciphers").
+func validateAlgorithms(flagName string, algorithms []string, supported []string) error {
+	for _, algorithm := range algorithms {
+		if !slices.Contains(supported, algorithm) {
+			return fmt.Errorf("unsupported algorithm in %s: %s (%s)", flagName, algorithm, strings.Join(supported, ", "))
+		}
+	}
+	return nil
+}
+
+// signatureAlgorithms returns the signature algorithms of the key type in preference order
+func signatureAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// newHostKeySigner returns the signer of the host key or the host certificate using only the allowed host key algorithms (nil means all).
+// The announced algorithms are returned as well. The signer is nil when no algorithm of the key is allowed.
+func newHostKeySigner(hostKey ssh.Signer, cert *ssh.Certificate, allowed []string) (ssh.Signer, []string, error) {
+	var algorithms []string
+	var announced []string
+	for _, algorithm := range signatureAlgorithms(hostKey.PublicKey().Type()) {
+		name := algorithm
+		if cert != nil {
+			name = certAlgorithms[algorithm]
+		}
+		if allowed == nil || slices.Contains(allowed, name) {
+			algorithms = append(algorithms, algorithm)
+			announced = append(announced, name)
+		}
+	}
+	if len(algorithms) == 0 {
+		return nil, nil, nil
+	}
+	signer := hostKey
+	if allowed != nil {
+		algorithmSigner, ok := hostKey.(ssh.AlgorithmSigner)
+		if !ok {
+			return nil, nil, fmt.Errorf("host key algorithms cannot be restricted for %s key", hostKey.PublicKey().Type())
+		}
+		multiAlgorithmSigner, err := ssh.NewSignerWithAlgorithms(algorithmSigner, algorithms)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer = multiAlgorithmSigner
+	}
+	if cert != nil {
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer = certSigner
+	}
+	return signer, announced, nil
+}
+
+// negotiatedAlgorithms are algorithms agreed in the first key exchange
+type negotiatedAlgorithms struct {
+	kex     string
+	hostKey string
+	// Client to server
+	cipher string
+	mac    string
+}
+
+// serverAlgorithms are algorithms offered by the server in preference order
+type serverAlgorithms struct {
+	kexAlgorithms     []string
+	ciphers           []string
+	macs              []string
+	hostKeyAlgorithms []string
+}
+
+// negotiate agrees algorithms in the same way as the key exchange of RFC 4253: the first algorithm of the client also supported by the server
+func (s *serverAlgorithms) negotiate(clientKexInit *kexInit) negotiatedAlgorithms {
+	findCommon := func(client []string, server []string) string {
+		for _, algorithm := range client {
+			if slices.Contains(server, algorithm) {
+				return algorithm
+			}
+		}
+		return ""
+	}
+	negotiated := negotiatedAlgorithms{
+		kex:     findCommon(clientKexInit.kexAlgorithms, s.kexAlgorithms),
+		hostKey: findCommon(clientKexInit.hostKeyAlgorithms, s.hostKeyAlgorithms),
+		cipher:  findCommon(clientKexInit.ciphersClientServer, s.ciphers),
+	}
+	if slices.Contains(aeadCiphers, negotiated.cipher) {
+		negotiated.mac = "implicit"
+	} else {
+		negotiated.mac = findCommon(clientKexInit.macsClientServer, s.macs)
+	}
+	return negotiated
+}
+
+// kexInit is SSH_MSG_KEXINIT of the client
+type kexInit struct {
+	kexAlgorithms       []string
+	hostKeyAlgorithms   []string
+	ciphersClientServer []string
+	macsClientServer    []string
+}
+
+const (
+	msgKexInit = 20
+	// The version line and the first packet are much smaller
+	kexInitRecorderMaxSize = 64 * 1024
+)
+
+// kexInitRecorderConn records the first SSH_MSG_KEXINIT sent by the client before encryption starts
+type kexInitRecorderConn struct {
+	net.Conn
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	done    bool
+	kexInit *kexInit
+}
+
+func (c *kexInitRecorderConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done && n > 0 {
+		c.buf.Write(b[:n])
+		c.kexInit, c.done = parseClientKexInit(c.buf.Bytes())
+		if c.buf.Len() > kexInitRecorderMaxSize {
+			c.done = true
+		}
+		if c.done {
+			c.buf = bytes.Buffer{}
+		}
+	}
+	return n, err
+}
+
+// clientKexInit returns nil when SSH_MSG_KEXINIT is not recorded
+func (c *kexInitRecorderConn) clientKexInit() *kexInit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.kexInit
+}
+
+// parseClientKexInit parses the version line and SSH_MSG_KEXINIT. done is false when more data is needed.
+func parseClientKexInit(b []byte) (result *kexInit, done bool) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return nil, false
+	}
+	b = b[i+1:]
+	// uint32 packet_length, byte padding_length, payload
+	if len(b) < 5 {
+		return nil, false
+	}
+	packetLength := binary.BigEndian.Uint32(b)
+	if packetLength > kexInitRecorderMaxSize {
+		return nil, true
+	}
+	if uint32(len(b)-4) < packetLength {
+		return nil, false
+	}
+	paddingLength := uint32(b[4])
+	if paddingLength+1 > packetLength {
+		return nil, true
+	}
+	payload := b[5 : 4+packetLength-paddingLength]
+	// byte SSH_MSG_KEXINIT, byte[16] cookie
+	if len(payload) < 17 || payload[0] != msgKexInit {
+		return nil, true
+	}
+	payload = payload[17:]
+	var nameLists [][]string
+	for len(nameLists) < 6 {
+		if len(payload) < 4 {
+			return nil, true
+		}
+		length := binary.BigEndian.Uint32(payload)
+		if uint32(len(payload)-4) < length {
+			return nil, true
+		}
+		nameLists = append(nameLists, strings.Split(string(payload[4:4+length]), ","))
+		payload = payload[4+length:]
+	}
+	return &kexInit{
+		kexAlgorithms:       nameLists[0],
+		hostKeyAlgorithms:   nameLists[1],
+		ciphersClientServer: nameLists[2],
+		macsClientServer:    nameLists[4],
+	}, true
+}
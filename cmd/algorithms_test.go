@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func dialWithConfig(address string, config ssh.Config, hostKeyAlgorithms []string) (*ssh.Client, error) {
+	return ssh.Dial("tcp", address, &ssh.ClientConfig{
+		Config:            config,
+		User:              "john",
+		Auth:              []ssh.AuthMethod{ssh.Password("mypass")},
+		HostKeyCallback:   ssh.InsecureIgnoreHostKey(),
+		HostKeyAlgorithms: hostKeyAlgorithms,
+	})
+}
+
+func assertDial(t *testing.T, address string, config ssh.Config, hostKeyAlgorithms []string, succeeds bool) {
+	client, err := dialWithConfig(address, config, hostKeyAlgorithms)
+	if succeeds {
+		assert.NoError(t, err)
+	} else {
+		assert.Error(t, err)
+	}
+	if err == nil {
+		client.Close()
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass", "--kex-algorithms", "ecdh-sha2-nistp384", "--ciphers", "aes256-ctr,aes128-gcm@openssh.com", "--macs", "hmac-sha2-512", "--host-key-algorithms", "ssh-ed25519")
+	assertDial(t, address, ssh.Config{Ciphers: []string{"aes256-ctr"}}, nil, true)
+	assertDial(t, address, ssh.Config{Ciphers: []string{"aes128-ctr"}}, nil, false)
+	assertDial(t, address, ssh.Config{KeyExchanges: []string{"curve25519-sha256"}}, nil, false)
+	assertDial(t, address, ssh.Config{Ciphers: []string{"aes256-ctr"}, MACs: []string{"hmac-sha1"}}, nil, false)
+	// MACs are not used by AEAD ciphers
+	assertDial(t, address, ssh.Config{Ciphers: []string{"aes128-gcm@openssh.com"}, MACs: []string{"hmac-sha1"}}, nil, true)
+}
+
+func TestAlgorithmsPreset(t *testing.T) {
+	stateDir := t.TempDir()
+	address := startServer(t, "--user", "john:mypass", "--algorithms-preset", "fips", "--state-dir", stateDir, "--host-key-types", "ed25519,ecdsa")
+	assertDial(t, address, ssh.Config{}, nil, true)
+	assertDial(t, address, ssh.Config{KeyExchanges: []string{"curve25519-sha256"}}, nil, false)
+	assertDial(t, address, ssh.Config{Ciphers: []string{"chacha20-poly1305@openssh.com"}}, nil, false)
+	assertDial(t, address, ssh.Config{}, []string{ssh.KeyAlgoED25519}, false)
+	assertDial(t, address, ssh.Config{}, []string{ssh.KeyAlgoECDSA256}, true)
+
+	// The flag takes precedence over the preset
+	address = startServer(t, "--user", "john:mypass", "--algorithms-preset", "fips", "--ciphers", "chacha20-poly1305@openssh.com", "--state-dir", stateDir, "--host-key-types", "ecdsa")
+	assertDial(t, address, ssh.Config{Ciphers: []string{"chacha20-poly1305@openssh.com"}}, nil, true)
+}
+
+func TestAlgorithmsErrors(t *testing.T) {
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{args: []string{"--ciphers", "aes256-cbc"}, expected: "unsupported algorithm in --ciphers: aes256-cbc"},
+		{args: []string{"--kex-algorithms", "diffie-hellman-group-exchange-sha256"}, expected: "unsupported algorithm in --kex-algorithms"},
+		{args: []string{"--algorithms-preset", "unknown"}, expected: "unknown algorithms preset: unknown (compat, fips, modern)"},
+		{args: []string{"--algorithms-preset", "fips", "--state-dir", t.TempDir()}, expected: "no host key usable with the host key algorithms"},
+	} {
+		rootCmd := RootCmd()
+		rootCmd.SetArgs(append([]string{"--user", "john:mypass"}, test.args...))
+		var stderrBuf bytes.Buffer
+		rootCmd.SetErr(&stderrBuf)
+		assert.Error(t, rootCmd.Execute())
+		assert.Contains(t, stderrBuf.String(), test.expected)
+	}
+}
+
+func TestHostCertificateAlgorithms(t *testing.T) {
+	hostKey, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	caKey, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	cert := &ssh.Certificate{Key: hostKey.PublicKey(), CertType: ssh.HostCert, ValidBefore: ssh.CertTimeInfinity}
+	assert.NoError(t, cert.SignCert(rand.Reader, caKey))
+
+	signer, algorithms, err := newHostKeySigner(hostKey, cert, []string{ssh.CertAlgoED25519v01})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ssh.CertAlgoED25519v01}, algorithms)
+	assert.Equal(t, ssh.CertAlgoED25519v01, signer.PublicKey().Type())
+	signer, _, err = newHostKeySigner(hostKey, cert, []string{ssh.KeyAlgoED25519})
+	assert.NoError(t, err)
+	assert.Nil(t, signer)
+}
+
+func TestNegotiatedAlgorithms(t *testing.T) {
+	hostKey, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(hostKey)
+	serverConfig.SetDefaults()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		client, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+			Config:          ssh.Config{Ciphers: []string{"aes192-ctr", "aes256-ctr"}, MACs: []string{"hmac-sha2-512"}, KeyExchanges: []string{"ecdh-sha2-nistp521"}},
+			User:            "john",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			client.Close()
+		}
+	}()
+	serverConn, err := ln.Accept()
+	assert.NoError(t, err)
+	recorderConn := &kexInitRecorderConn{Conn: serverConn}
+	conn, _, _, err := ssh.NewServerConn(recorderConn, serverConfig)
+	assert.NoError(t, err)
+	defer conn.Close()
+	offered := &serverAlgorithms{kexAlgorithms: serverConfig.KeyExchanges, ciphers: serverConfig.Ciphers, macs: serverConfig.MACs, hostKeyAlgorithms: []string{ssh.KeyAlgoED25519}}
+	assert.Equal(t, negotiatedAlgorithms{kex: "ecdh-sha2-nistp521", hostKey: ssh.KeyAlgoED25519, cipher: "aes192-ctr", mac: "hmac-sha2-512"}, offered.negotiate(recorderConn.clientKexInit()))
+}
+
+func TestConfigFile(t *testing.T) {
+	configPath := path.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(configPath, []byte(`
+user:
+  - john:mypass
+ciphers: [aes256-ctr, aes128-ctr]
+macs: hmac-sha2-256
+allow-execute: true
+`), 0600))
+	address := startServer(t, "--config", configPath, "--ciphers", "aes128-ctr")
+	// The command line takes precedence
+	assertDial(t, address, ssh.Config{Ciphers: []string{"aes128-ctr"}}, nil, true)
+	assertDial(t, address, ssh.Config{Ciphers: []string{"aes256-ctr"}}, nil, false)
+	assertDial(t, address, ssh.Config{Ciphers: []string{"aes128-ctr"}, MACs: []string{"hmac-sha2-512"}}, nil, false)
+
+	assert.NoError(t, os.WriteFile(configPath, []byte("unknown-flag: true\n"), 0600))
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{"--config", configPath})
+	var stderrBuf bytes.Buffer
+	rootCmd.SetErr(&stderrBuf)
+	assert.Error(t, rootCmd.Execute())
+	assert.Contains(t, stderrBuf.String(), "unknown key: unknown-flag")
+}
@@ -0,0 +1,327 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/nwtgck/handy-sshd"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+	"strings"
+)
+
+// Authentication method names (the same as OpenSSH)
+const (
+	authMethodPublicKey           = "publickey"
+	authMethodPassword            = "password"
+	authMethodKeyboardInteractive = "keyboard-interactive"
+)
+
+var authMethods = []string{authMethodPublicKey, authMethodPassword, authMethodKeyboardInteractive}
+
+// parseAuthenticationMethods parses chains in the format of AuthenticationMethods of OpenSSH (e.g. "publickey,password")
+func parseAuthenticationMethods(chains []string) ([][]string, error) {
+	var result [][]string
+	for _, chain := range chains {
+		methods := strings.Split(chain, ",")
+		for _, method := range methods {
+			if !slices.Contains(authMethods, method) {
+				return nil, fmt.Errorf("unknown authentication method: %q (%s)", method, strings.Join(authMethods, ", "))
+			}
+		}
+		result = append(result, methods)
+	}
+	return result, nil
+}
+
+// authenticator authenticates users of --user and --users-file with multi-step authentication
+type authenticator struct {
+	logger                      *slog.Logger
+	users                       *userStore
+	globalAuthorizedKeysSources []authorizedKeysSource
+	certChecker                 *ssh.CertChecker
+	totp                        *totpVerifier
+	// Asked for user names not in --user, --users-file and --system-users
+	hooks []authHook
+	// nil when brute-force protection is disabled
+	failures *authFailures
+}
+
+// authState is the progress of multi-step authentication of a connection. It is not modified after creation.
+type authState struct {
+	// nil before the first method succeeds
+	user      *sshUser
+	succeeded []string
+	perms     *ssh.Permissions
+}
+
+// authChains returns the chains of methods the user has to complete. nil means any single method.
+func (u *sshUser) authChains() [][]string {
+	if u.authenticationMethods != nil {
+		return u.authenticationMethods
+	}
+	if u.totpSecret == nil {
+		return nil
+	}
+	// The TOTP code is asked with keyboard-interactive
+	var chains [][]string
+	if len(u.authorizedKeysSources) != 0 {
+		chains = append(chains, []string{authMethodPublicKey, authMethodKeyboardInteractive})
+	}
+	if u.password != "" {
+		chains = append(chains, []string{authMethodPassword, authMethodKeyboardInteractive})
+	}
+	// keyboard-interactive alone asks both the password and the code
+	if u.password != "" {
+		chains = append(chains, []string{authMethodKeyboardInteractive})
+	}
+	return chains
+}
+
+// validateTotpFactors rejects the TOTP code as the only factor because 6 digits can be brute-forced within the window
+func (u *sshUser) validateTotpFactors() error {
+	if u.totpSecret == nil {
+		return nil
+	}
+	if u.password == "" && len(u.authorizedKeysSources) == 0 {
+		return fmt.Errorf("totp_secret without password or authorized keys")
+	}
+	if u.password != "" {
+		return nil
+	}
+	// keyboard-interactive asks only the code for the user without password
+	for _, chain := range u.authenticationMethods {
+		if !slices.Contains(chain, authMethodPublicKey) && !slices.Contains(chain, authMethodPassword) {
+			return fmt.Errorf("authentication method chain %q only with the TOTP code", strings.Join(chain, ","))
+		}
+	}
+	return nil
+}
+
+// candidates returns the user authenticating in the state or the users of the name
+func (a *authenticator) candidates(state *authState, name string) []sshUser {
+	if state.user != nil {
+		return []sshUser{*state.user}
+	}
+	var users []sshUser
+	for _, user := range a.users.users() {
+		if user.name == name {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// allows returns true if the method is the next one of the user's chains
+func (a *authenticator) allows(user *sshUser, state *authState, method string) bool {
+	chains := user.authChains()
+	if chains == nil {
+		return len(state.succeeded) == 0
+	}
+	for _, chain := range chains {
+		if len(chain) > len(state.succeeded) && slices.Equal(chain[:len(state.succeeded)], state.succeeded) && chain[len(state.succeeded)] == method {
+			return true
+		}
+	}
+	return false
+}
+
+// advance completes authentication when a chain is satisfied by the method. Otherwise, it returns ssh.PartialSuccessError with the next methods.
+func (a *authenticator) advance(metadata ssh.ConnMetadata, user sshUser, state *authState, method string, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	next := &authState{user: &user, succeeded: append(append([]string{}, state.succeeded...), method), perms: state.perms}
+	// Restrictions of the public key take precedence
+	if next.perms == nil || method == authMethodPublicKey {
+		next.perms = perms
+	}
+	chains := user.authChains()
+	if chains == nil {
+		return next.perms, nil
+	}
+	nextMethods := map[string]struct{}{}
+	for _, chain := range chains {
+		if slices.Equal(chain, next.succeeded) {
+			a.logger.Info("authentication chain satisfied", "user", metadata.User(), "methods", strings.Join(chain, ","))
+			return next.perms, nil
+		}
+		if len(chain) > len(next.succeeded) && slices.Equal(chain[:len(next.succeeded)], next.succeeded) {
+			nextMethods[chain[len(next.succeeded)]] = struct{}{}
+		}
+	}
+	var callbacks ssh.ServerAuthCallbacks
+	if _, ok := nextMethods[authMethodPublicKey]; ok {
+		callbacks.PublicKeyCallback = a.publicKeyCallback(next)
+	}
+	if _, ok := nextMethods[authMethodPassword]; ok {
+		callbacks.PasswordCallback = a.passwordCallback(next)
+	}
+	if _, ok := nextMethods[authMethodKeyboardInteractive]; ok {
+		callbacks.KeyboardInteractiveCallback = a.keyboardInteractiveCallback(next)
+	}
+	return nil, &ssh.PartialSuccessError{Next: callbacks}
+}
+
+func (a *authenticator) passwordCallback(state *authState) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+	return func(metadata ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+		if err := a.checkFrom(metadata); err != nil {
+			return nil, err
+		}
+		candidates := a.candidates(state, metadata.User())
+		for _, user := range candidates {
+			if !a.allows(&user, state, authMethodPassword) {
+				continue
+			}
+			// The user without password (e.g. only with authorized keys) does not accept password
+			if user.password == "" && !user.requiresNoAuth() {
+				continue
+			}
+			if user.checkPassword(pass) {
+				return a.advance(metadata, user, state, authMethodPassword, user.permissions(nil))
+			}
+		}
+		// Known users are not passed to the hooks not to bypass their passwords and chains
+		if len(candidates) == 0 {
+			if perms, ok := a.authenticateWithHooks(metadata, &authHookRequest{Method: authMethodPassword, Password: string(pass)}); ok {
+				return perms, nil
+			}
+		}
+		return nil, fmt.Errorf("password rejected for %q", metadata.User())
+	}
+}
+
+func (a *authenticator) publicKeyCallback(state *authState) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(metadata ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if err := a.checkFrom(metadata); err != nil {
+			return nil, err
+		}
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			return a.authorizedKeysCallback(state, metadata, key)
+		}
+		// x/crypto/ssh accepts certificates without principals for any users but OpenSSH does not
+		if len(cert.ValidPrincipals) == 0 {
+			return nil, fmt.Errorf("certificate without principals rejected for %q", metadata.User())
+		}
+		// Principals, validity and critical options are checked
+		if _, err := a.certChecker.Authenticate(metadata, key); err != nil {
+			a.logger.Info("certificate rejected", "user", metadata.User(), "key_id", cert.KeyId, "err", err)
+			return nil, err
+		}
+		permissions := handy_sshd.PermissionsFromCertificate(cert)
+		for _, user := range a.candidates(state, metadata.User()) {
+			if !a.allows(&user, state, authMethodPublicKey) {
+				return nil, fmt.Errorf("publickey not allowed for %q at this step", metadata.User())
+			}
+			return a.advance(metadata, user, state, authMethodPublicKey, user.permissions(permissions))
+		}
+		// Users are principals of certificates
+		return permissions, nil
+	}
+}
+
+func (a *authenticator) authorizedKeysCallback(state *authState, metadata ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	candidates := a.candidates(state, metadata.User())
+	for _, user := range candidates {
+		if !a.allows(&user, state, authMethodPublicKey) {
+			continue
+		}
+		for _, sources := range [][]authorizedKeysSource{a.globalAuthorizedKeysSources, user.authorizedKeysSources} {
+			for _, source := range sources {
+				keys, err := source.authorizedKeys()
+				if err != nil {
+					a.logger.Error("failed to load authorized keys", "source", source.String(), "err", err)
+					continue
+				}
+				for _, authorizedKey := range keys {
+					if !authorizedKey.matches(key) {
+						continue
+					}
+					permissions, err := handy_sshd.PermissionsFromAuthorizedKeyOptions(authorizedKey.options, metadata.RemoteAddr())
+					if err != nil {
+						a.logger.Info("public key not allowed by its options", "user", metadata.User(), "source", source.String(), "err", err)
+						continue
+					}
+					return a.advance(metadata, user, state, authMethodPublicKey, user.permissions(permissions))
+				}
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		request := &authHookRequest{
+			Method:               authMethodPublicKey,
+			PublicKey:            strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+			PublicKeyFingerprint: ssh.FingerprintSHA256(key),
+		}
+		if perms, ok := a.authenticateWithHooks(metadata, request); ok {
+			return perms, nil
+		}
+	}
+	return nil, fmt.Errorf("public key rejected for %q", metadata.User())
+}
+
+// keyboardInteractiveCallback asks the password and the TOTP code.
+// The password is not asked when the user has no password or the TOTP code follows another method.
+func (a *authenticator) keyboardInteractiveCallback(state *authState) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	return func(metadata ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		if err := a.checkFrom(metadata); err != nil {
+			return nil, err
+		}
+		for _, user := range a.candidates(state, metadata.User()) {
+			if !a.allows(&user, state, authMethodKeyboardInteractive) {
+				continue
+			}
+			asksPassword := user.password != "" && !slices.Contains(state.succeeded, authMethodPassword) && (user.totpSecret == nil || len(state.succeeded) == 0)
+			asksTotp := user.totpSecret != nil
+			if !asksPassword && !asksTotp {
+				continue
+			}
+			var questions []string
+			if asksPassword {
+				questions = append(questions, "Password: ")
+			}
+			if asksTotp {
+				questions = append(questions, totpPrompt)
+			}
+			answers, err := client("", "", questions, make([]bool, len(questions)))
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != len(questions) {
+				return nil, fmt.Errorf("keyboard-interactive rejected for %q", metadata.User())
+			}
+			if asksPassword && !user.checkPassword([]byte(answers[0])) {
+				return nil, fmt.Errorf("password rejected for %q", metadata.User())
+			}
+			if asksTotp && !a.totp.verify(&user, answers[len(answers)-1]) {
+				return nil, fmt.Errorf("verification code rejected for %q", metadata.User())
+			}
+			return a.advance(metadata, user, state, authMethodKeyboardInteractive, user.permissions(nil))
+		}
+		return nil, fmt.Errorf("keyboard-interactive rejected for %q", metadata.User())
+	}
+}
+
+// checkFrom rejects the user name when one of the users of the name does not allow the source address with from
+func (a *authenticator) checkFrom(metadata ssh.ConnMetadata) error {
+	for _, user := range a.users.users() {
+		if user.name != metadata.User() || user.from == "" {
+			continue
+		}
+		if err := handy_sshd.MatchFrom(user.from, metadata.RemoteAddr()); err != nil {
+			a.logger.Info("user not allowed from the address", "user", metadata.User(), "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *authenticator) noClientAuthCallback(metadata ssh.ConnMetadata) (*ssh.Permissions, error) {
+	if err := a.checkFrom(metadata); err != nil {
+		return nil, err
+	}
+	for _, user := range a.users.users() {
+		// No auth required
+		if user.name == metadata.User() && user.requiresNoAuth() {
+			return user.permissions(nil), nil
+		}
+	}
+	return nil, fmt.Errorf("%s auth required", metadata.User())
+}
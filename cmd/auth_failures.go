@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Failures not delayed not to penalize typos
+	authFailureFreeTries = 3
+	// Delay of the first delayed failure doubled on every failure after that
+	authFailureBaseDelay = 250 * time.Millisecond
+	authFailureMaxDelay  = 5 * time.Second
+)
+
+// authFailures tracks failed authentication attempts per source IP and per user name in a sliding window.
+// Source IPs over the limit are banned and their connections are refused before the handshake.
+// User names are not locked not to let anyone lock out the owners. Their failures only delay responses.
+// Public key attempts are not counted because clients offer their keys in turn.
+type authFailures struct {
+	logger      *slog.Logger
+	limit       int
+	window      time.Duration
+	banDuration time.Duration
+
+	mu       sync.Mutex
+	failures map[authFailureKey][]time.Time
+	// Expiry times of bans
+	bans map[authFailureKey]time.Time
+}
+
+type authFailureKey struct {
+	// "remote_ip" or "user"
+	kind  string
+	value string
+}
+
+func newAuthFailures(logger *slog.Logger, limit int, window time.Duration, banDuration time.Duration) *authFailures {
+	return &authFailures{
+		logger:      logger,
+		limit:       limit,
+		window:      window,
+		banDuration: banDuration,
+		failures:    map[authFailureKey][]time.Time{},
+		bans:        map[authFailureKey]time.Time{},
+	}
+}
+
+// remoteIPKey returns the key of the source IP. Connections not over TCP (e.g. Unix domain socket) have no source IP.
+func remoteIPKey(addr net.Addr) (authFailureKey, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return authFailureKey{}, false
+	}
+	return authFailureKey{kind: "remote_ip", value: tcpAddr.IP.String()}, true
+}
+
+func userKey(name string) authFailureKey {
+	return authFailureKey{kind: "user", value: name}
+}
+
+// expire removes failures out of the window and bans expired
+func (f *authFailures) expire(now time.Time) {
+	for key, until := range f.bans {
+		if !now.Before(until) {
+			delete(f.bans, key)
+			f.logger.Info("unbanned", key.kind, key.value)
+		}
+	}
+	for key, times := range f.failures {
+		i := 0
+		for i < len(times) && now.Sub(times[i]) >= f.window {
+			i++
+		}
+		if i == len(times) {
+			delete(f.failures, key)
+		} else {
+			f.failures[key] = times[i:]
+		}
+	}
+}
+
+func (f *authFailures) banned(key authFailureKey) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire(time.Now())
+	_, ok := f.bans[key]
+	return ok
+}
+
+// remoteIPBanned returns true when connections from the address should be refused
+func (f *authFailures) remoteIPBanned(addr net.Addr) bool {
+	key, ok := remoteIPKey(addr)
+	if !ok {
+		return false
+	}
+	return f.banned(key)
+}
+
+// fail records a failure and returns the delay of the response growing with the failures
+func (f *authFailures) fail(metadata ssh.ConnMetadata) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	f.expire(now)
+	keys := []authFailureKey{userKey(metadata.User())}
+	if key, ok := remoteIPKey(metadata.RemoteAddr()); ok {
+		keys = append(keys, key)
+	}
+	count := 0
+	for _, key := range keys {
+		f.failures[key] = append(f.failures[key], now)
+		n := len(f.failures[key])
+		if n > count {
+			count = n
+		}
+		if _, ok := f.bans[key]; !ok && key.kind == "remote_ip" && n >= f.limit {
+			f.bans[key] = now.Add(f.banDuration)
+			// Failures before the ban do not count toward the next ban
+			delete(f.failures, key)
+			f.logger.Warn("banned after too many authentication failures", key.kind, key.value, "failures", n, "duration", f.banDuration)
+		}
+	}
+	return authFailureDelay(count)
+}
+
+// succeed forgets failures of the user. Failures of the source IP expire in the window not to be reset by logins of an attacker's own account.
+func (f *authFailures) succeed(metadata ssh.ConnMetadata) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.failures, userKey(metadata.User()))
+}
+
+// authFailureDelay returns the delay of the n-th failure
+func authFailureDelay(n int) time.Duration {
+	if n <= authFailureFreeTries {
+		return 0
+	}
+	delay := authFailureBaseDelay
+	for i := authFailureFreeTries + 1; i < n && delay < authFailureMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > authFailureMaxDelay {
+		delay = authFailureMaxDelay
+	}
+	return delay
+}
+
+// authLogCallback records results of authentication methods. The delay blocks only the connection of the failure.
+func (f *authFailures) authLogCallback(metadata ssh.ConnMetadata, method string, err error) {
+	if err == nil {
+		f.succeed(metadata)
+		return
+	}
+	if method == "none" || method == authMethodPublicKey {
+		return
+	}
+	// A step of multi-step authentication succeeded
+	var partialSuccessError *ssh.PartialSuccessError
+	if errors.As(err, &partialSuccessError) {
+		return
+	}
+	time.Sleep(f.fail(metadata))
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuthFailuresBan(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass", "--auth-failures-limit", "3", "--auth-ban-duration", "1s")
+	for i := 0; i < 3; i++ {
+		_, err := dialWithPassword(address, "john", "mywrongpassword")
+		assert.Error(t, err)
+	}
+	// Refused before the handshake even with the correct password
+	conn, err := net.Dial("tcp", address)
+	assert.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	conn.Close()
+	_, err = dialWithPassword(address, "john", "mypass")
+	assert.Error(t, err)
+
+	time.Sleep(1100 * time.Millisecond)
+	client, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	if err == nil {
+		client.Close()
+	}
+}
+
+func TestMaxAuthTries(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass", "--max-auth-tries", "2")
+	tries := 0
+	_, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User: "john",
+		Auth: []ssh.AuthMethod{ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+			tries++
+			return "mywrongpassword", nil
+		}), 5)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 2, tries)
+}
+
+type fakeConnMetadata struct {
+	ssh.ConnMetadata
+	user       string
+	remoteAddr net.Addr
+}
+
+func (m *fakeConnMetadata) User() string         { return m.user }
+func (m *fakeConnMetadata) RemoteAddr() net.Addr { return m.remoteAddr }
+
+func TestAuthFailuresUserNotLocked(t *testing.T) {
+	failures := newAuthFailures(slog.Default(), 3, time.Minute, time.Minute)
+	var delay time.Duration
+	for i := 0; i < 5; i++ {
+		// From different IPs
+		delay = failures.fail(&fakeConnMetadata{user: "john", remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 22}})
+	}
+	// Failures of the user name only delay responses
+	assert.Equal(t, authFailureDelay(5), delay)
+	assert.Empty(t, failures.bans)
+	// Public keys are not counted
+	for i := 0; i < 3; i++ {
+		failures.authLogCallback(&fakeConnMetadata{user: "alice", remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 0), Port: 22}}, authMethodPublicKey, io.EOF)
+	}
+	assert.Empty(t, failures.failures[userKey("alice")])
+}
+
+func TestAuthFailuresNotResetBySuccess(t *testing.T) {
+	failures := newAuthFailures(slog.Default(), 3, time.Minute, time.Minute)
+	remoteAddr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	for i := 0; i < 3; i++ {
+		failures.authLogCallback(&fakeConnMetadata{user: "john", remoteAddr: remoteAddr}, authMethodPassword, io.EOF)
+		// The attacker's own account
+		failures.authLogCallback(&fakeConnMetadata{user: "alice", remoteAddr: remoteAddr}, authMethodPublicKey, nil)
+		failures.authLogCallback(&fakeConnMetadata{user: "alice", remoteAddr: remoteAddr}, authMethodPassword, nil)
+	}
+	assert.True(t, failures.remoteIPBanned(remoteAddr))
+
+	// The user's failures are reset
+	failures = newAuthFailures(slog.Default(), 3, time.Minute, time.Minute)
+	for i := 0; i < 3; i++ {
+		failures.authLogCallback(&fakeConnMetadata{user: "john", remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 22}}, authMethodPassword, io.EOF)
+		failures.authLogCallback(&fakeConnMetadata{user: "john", remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 22}}, authMethodPassword, nil)
+	}
+	assert.Empty(t, failures.failures[userKey("john")])
+}
+
+func TestAuthFailureDelay(t *testing.T) {
+	assert.Equal(t, time.Duration(0), authFailureDelay(3))
+	assert.Equal(t, 250*time.Millisecond, authFailureDelay(4))
+	assert.Equal(t, 500*time.Millisecond, authFailureDelay(5))
+	assert.Equal(t, 5*time.Second, authFailureDelay(100))
+}
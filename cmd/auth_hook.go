@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mattn/go-shellwords"
+	"github.com/nwtgck/handy-sshd"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	authHookTimeout = 10 * time.Second
+	// Max size of the response of --auth-command and --auth-url
+	authHookMaxResponseSize = 1 << 20
+)
+
+// authHookRequest is passed to --auth-command on stdin and --auth-url as the POST body in JSON
+type authHookRequest struct {
+	User          string `json:"user"`
+	Method        string `json:"method"`
+	RemoteAddress string `json:"remote_address"`
+	Password      string `json:"password,omitempty"`
+	// authorized_keys format (e.g. "ssh-ed25519 AAAA...")
+	PublicKey            string `json:"public_key,omitempty"`
+	PublicKeyFingerprint string `json:"public_key_fingerprint,omitempty"`
+}
+
+// authHookResponse is the optional JSON output of --auth-command and response body of --auth-url
+type authHookResponse struct {
+	// Permission names replacing --allow-* flags (e.g. ["tcpip-forward"])
+	Permissions *[]string `json:"permissions"`
+	// Options in authorized_keys format (e.g. ["no-pty", "permitopen=localhost:8080"])
+	Options []string `json:"options"`
+}
+
+// authHook asks an external program or service whether the client is allowed
+type authHook interface {
+	authenticate(request *authHookRequest) (allowed bool, response *authHookResponse, err error)
+	String() string
+}
+
+// authCommand allows the client when the command exits with 0
+type authCommand struct {
+	command string
+}
+
+func (c *authCommand) authenticate(request *authHookRequest) (bool, *authHookResponse, error) {
+	args, err := shellwords.Parse(c.command)
+	if err != nil {
+		return false, nil, err
+	}
+	if len(args) == 0 {
+		return false, nil, errors.New("empty command")
+	}
+	requestJson, err := json.Marshal(request)
+	if err != nil {
+		return false, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), authHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(requestJson)
+	stdout, err := cmd.Output()
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) && ctx.Err() == nil {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	response, err := parseAuthHookResponse(stdout)
+	return err == nil, response, err
+}
+
+func (c *authCommand) String() string {
+	return c.command
+}
+
+// authURL allows the client when the server responds 200 and denies on 401 and 403
+type authURL struct {
+	url    string
+	client *http.Client
+}
+
+func (u *authURL) authenticate(request *authHookRequest) (bool, *authHookResponse, error) {
+	requestJson, err := json.Marshal(request)
+	if err != nil {
+		return false, nil, err
+	}
+	res, err := u.client.Post(u.url, "application/json", bytes.NewReader(requestJson))
+	if err != nil {
+		return false, nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, authHookMaxResponseSize+1))
+	if err != nil {
+		return false, nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		if len(body) > authHookMaxResponseSize {
+			return false, nil, errors.New("response too large")
+		}
+		response, err := parseAuthHookResponse(body)
+		return err == nil, response, err
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, nil, nil
+	default:
+		return false, nil, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+}
+
+func (u *authURL) String() string {
+	return u.url
+}
+
+// parseAuthHookResponse parses the response. Empty means no restriction.
+func parseAuthHookResponse(b []byte) (*authHookResponse, error) {
+	var response authHookResponse
+	if len(bytes.TrimSpace(b)) == 0 {
+		return &response, nil
+	}
+	if len(b) > authHookMaxResponseSize {
+		return nil, errors.New("response too large")
+	}
+	if err := json.Unmarshal(b, &response); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &response, nil
+}
+
+// permissions converts the response into ssh.Permissions which Server honors
+func (r *authHookResponse) permissions(metadata ssh.ConnMetadata) (*ssh.Permissions, error) {
+	perms, err := handy_sshd.PermissionsFromAuthorizedKeyOptions(r.Options, metadata.RemoteAddr())
+	if err != nil {
+		return nil, err
+	}
+	if r.Permissions != nil {
+		perms.Extensions[handy_sshd.ExtensionPermissions] = strings.Join(*r.Permissions, ",")
+	}
+	return perms, nil
+}
+
+// authenticateWithHooks asks the hooks in order and returns the permissions of the first hook allowing the client
+func (a *authenticator) authenticateWithHooks(metadata ssh.ConnMetadata, request *authHookRequest) (*ssh.Permissions, bool) {
+	request.User = metadata.User()
+	request.RemoteAddress = metadata.RemoteAddr().String()
+	for _, hook := range a.hooks {
+		allowed, response, err := hook.authenticate(request)
+		if err != nil {
+			a.logger.Error("auth hook failed", "hook", hook.String(), "user", request.User, "method", request.Method, "err", err)
+			continue
+		}
+		if !allowed {
+			continue
+		}
+		perms, err := response.permissions(metadata)
+		if err != nil {
+			a.logger.Info("auth hook response not applicable", "hook", hook.String(), "user", request.User, "err", err)
+			continue
+		}
+		a.logger.Info("allowed by auth hook", "hook", hook.String(), "user", request.User, "method", request.Method)
+		return perms, true
+	}
+	return nil, false
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestAuthCommand(t *testing.T) {
+	scriptPath := path.Join(t.TempDir(), "auth.sh")
+	// Allows john with "mypass" and alice only with execute
+	assert.NoError(t, os.WriteFile(scriptPath, []byte(`#!/bin/sh
+request=$(cat)
+case "$request" in
+  *'"user":"john"'*'"password":"mypass"'*) exit 0 ;;
+  *'"user":"alice"'*'"password":"alicepass"'*) echo '{"permissions": ["execute"]}'; exit 0 ;;
+esac
+exit 1
+`), 0700))
+	address := startServer(t, "--auth-command", scriptPath, "--allow-direct-tcpip", "--allow-execute")
+
+	johnClient, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer johnClient.Close()
+	assertExec(t, johnClient)
+	assertLocalPortForwarding(t, johnClient)
+	_, err = dialWithPassword(address, "john", "mywrongpassword")
+	assert.Error(t, err)
+
+	aliceClient, err := dialWithPassword(address, "alice", "alicepass")
+	assert.NoError(t, err)
+	defer aliceClient.Close()
+	assertExec(t, aliceClient)
+	assertNoLocalPortForwarding(t, aliceClient)
+}
+
+func TestAuthCommandWithUsers(t *testing.T) {
+	scriptPath := path.Join(t.TempDir(), "auth.sh")
+	assert.NoError(t, os.WriteFile(scriptPath, []byte("#!/bin/sh\ngrep -q '\"password\":\"hookpass\"'\n"), 0700))
+	address := startServer(t, "--user", "john:mypass", "--auth-command", scriptPath)
+
+	client, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	client.Close()
+	// The hook is asked for users not in --user
+	client, err = dialWithPassword(address, "bob", "hookpass")
+	assert.NoError(t, err)
+	client.Close()
+	_, err = dialWithPassword(address, "bob", "mypass")
+	assert.Error(t, err)
+}
+
+func TestAuthCommandNotAskedForKnownUsers(t *testing.T) {
+	signer, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	otherSigner, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	usersFilePath := path.Join(dir, "users.yaml")
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte(fmt.Sprintf(`
+users:
+  - name: john
+    password: mypass
+    authorized_keys: ['%s']
+    authentication_methods: ["publickey,keyboard-interactive"]
+`, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))))), 0600))
+	// Allows everyone
+	scriptPath := path.Join(dir, "auth.sh")
+	assert.NoError(t, os.WriteFile(scriptPath, []byte("#!/bin/sh\nexit 0\n"), 0700))
+	address := startUsersFileServer(t, usersFilePath, "--auth-command", scriptPath)
+
+	// The chain of john is required
+	_, err = dialWithPassword(address, "john", "mypass")
+	assert.Error(t, err)
+	_, err = dialWithPassword(address, "john", "anypass")
+	assert.Error(t, err)
+	_, err = ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "john",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(otherSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.Error(t, err)
+	// Unknown users are asked to the hook
+	client, err := dialWithPassword(address, "bob", "anypass")
+	assert.NoError(t, err)
+	client.Close()
+}
+
+func TestAuthUrl(t *testing.T) {
+	aliceSigner, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	var requests []authHookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request authHookRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		requests = append(requests, request)
+		switch {
+		case request.User == "john" && request.Password == "mypass":
+			w.Write([]byte(`{"options": ["no-port-forwarding"]}`))
+		case request.User == "alice" && request.PublicKeyFingerprint == ssh.FingerprintSHA256(aliceSigner.PublicKey()):
+			w.Write([]byte(`{"permissions": []}`))
+		case request.User == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	address := startServer(t, "--auth-url", server.URL, "--allow-direct-tcpip", "--allow-execute")
+
+	johnClient, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer johnClient.Close()
+	assertExec(t, johnClient)
+	assertNoLocalPortForwarding(t, johnClient)
+	assert.Equal(t, authMethodPassword, requests[0].Method)
+	assert.True(t, strings.HasPrefix(requests[0].RemoteAddress, "127.0.0.1:"))
+
+	_, err = dialWithPassword(address, "john", "mywrongpassword")
+	assert.Error(t, err)
+	_, err = dialWithPassword(address, "broken", "mypass")
+	assert.Error(t, err)
+
+	aliceClient, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(aliceSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer aliceClient.Close()
+	assertNoExec(t, aliceClient)
+	assertNoLocalPortForwarding(t, aliceClient)
+	assert.Equal(t, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(aliceSigner.PublicKey()))), requests[len(requests)-1].PublicKey)
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticationMethods(t *testing.T) {
+	signer, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	usersFilePath := path.Join(t.TempDir(), "users.yaml")
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte(fmt.Sprintf(`
+users:
+  - name: john
+    password: mypass
+    authorized_keys: ['%[1]s']
+    authentication_methods: ["publickey,password"]
+  - name: alice
+    password: mypass
+    authorized_keys: ['%[1]s']
+    authentication_methods: ["publickey,keyboard-interactive", "password,publickey"]
+`, authorizedKey)), 0600))
+	address := startUsersFileServer(t, usersFilePath)
+	keyboardInteractive := ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		assert.Equal(t, []string{"Password: "}, questions)
+		return []string{"mypass"}, nil
+	})
+	dial := func(user string, authMethods ...ssh.AuthMethod) error {
+		client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+			User:            user,
+			Auth:            authMethods,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	}
+
+	assert.Error(t, dial("john", ssh.PublicKeys(signer)))
+	assert.Error(t, dial("john", ssh.Password("mypass")))
+	assert.Error(t, dial("john", ssh.PublicKeys(signer), ssh.Password("mywrongpass")))
+	// The order of the chain is required
+	assert.Error(t, dial("john", ssh.Password("mypass"), ssh.PublicKeys(signer)))
+	assert.Error(t, dial("john", ssh.PublicKeys(signer), keyboardInteractive))
+	assert.NoError(t, dial("john", ssh.PublicKeys(signer), ssh.Password("mypass")))
+
+	assert.Error(t, dial("alice", ssh.PublicKeys(signer)))
+	assert.NoError(t, dial("alice", ssh.PublicKeys(signer), keyboardInteractive))
+	assert.NoError(t, dial("alice", ssh.Password("mypass"), ssh.PublicKeys(signer)))
+}
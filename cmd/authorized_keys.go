@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type authorizedKey struct {
+	publicKey ssh.PublicKey
+	// (e.g. `no-pty`, `command="echo hello"`)
+	options []string
+}
+
+// authorizedKeysSource provides public keys in OpenSSH authorized_keys format
+type authorizedKeysSource interface {
+	authorizedKeys() ([]authorizedKey, error)
+	String() string
+}
+
+// authorizedKeysFile is read on every authentication so that modifications are applied without restart
+type authorizedKeysFile struct {
+	path string
+	// No keys instead of an error when the file does not exist (e.g. ~/.ssh/authorized_keys of system users)
+	optional bool
+}
+
+func (f *authorizedKeysFile) authorizedKeys() ([]authorizedKey, error) {
+	b, err := os.ReadFile(f.path)
+	if f.optional && errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseAuthorizedKeys(b), nil
+}
+
+func (f *authorizedKeysFile) String() string {
+	return f.path
+}
+
+// parseAuthorizedKeys parses authorized_keys content. Empty lines, comments and invalid lines are skipped in the same way as ssh.ParseAuthorizedKey().
+func parseAuthorizedKeys(b []byte) []authorizedKey {
+	var keys []authorizedKey
+	for len(b) > 0 {
+		publicKey, _, options, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			// no more keys
+			break
+		}
+		keys = append(keys, authorizedKey{publicKey: publicKey, options: options})
+		b = rest
+	}
+	return keys
+}
+
+func (k *authorizedKey) matches(publicKey ssh.PublicKey) bool {
+	return bytes.Equal(k.publicKey.Marshal(), publicKey.Marshal())
+}
+
+// authorizedKeysList is a fixed list of public keys (e.g. keys in --users-file)
+type authorizedKeysList struct {
+	name string
+	keys []authorizedKey
+}
+
+func (l *authorizedKeysList) authorizedKeys() ([]authorizedKey, error) {
+	return l.keys, nil
+}
+
+func (l *authorizedKeysList) String() string {
+	return l.name
+}
+
+const (
+	authorizedKeysURLTimeout = 10 * time.Second
+	// Max size of authorized_keys fetched from a URL
+	authorizedKeysURLMaxSize = 1 << 20
+	// Time from a failed fetch to the next fetch not to wait for the timeout on every authentication
+	authorizedKeysURLRetryInterval = 30 * time.Second
+)
+
+// authorizedKeysURL fetches authorized_keys from a URL (e.g. https://github.com/john.keys) on demand and caches them for ttl.
+// The last fetched keys are used when fetching fails.
+type authorizedKeysURL struct {
+	url    string
+	client *http.Client
+	ttl    time.Duration
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	keys      []authorizedKey
+	fetchedAt time.Time
+	// Not fetched again until retryAt after a failure
+	retryAt  time.Time
+	fetchErr error
+	// Closed when the fetch in progress finishes. nil when not fetching.
+	fetching chan struct{}
+}
+
+func (u *authorizedKeysURL) authorizedKeys() ([]authorizedKey, error) {
+	u.mu.Lock()
+	for {
+		if !u.fetchedAt.IsZero() && time.Since(u.fetchedAt) < u.ttl {
+			defer u.mu.Unlock()
+			return u.keys, nil
+		}
+		if time.Now().Before(u.retryAt) || (u.fetching != nil && !u.fetchedAt.IsZero()) {
+			defer u.mu.Unlock()
+			return u.cachedKeys()
+		}
+		if u.fetching == nil {
+			break
+		}
+		// Only one request to the URL at a time
+		fetching := u.fetching
+		u.mu.Unlock()
+		<-fetching
+		u.mu.Lock()
+	}
+	fetching := make(chan struct{})
+	u.fetching = fetching
+	u.mu.Unlock()
+
+	// Fetched without the lock not to block authentications with the cached keys
+	keys, err := u.fetch()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fetching = nil
+	close(fetching)
+	if err != nil {
+		u.fetchErr = err
+		u.retryAt = time.Now().Add(authorizedKeysURLRetryInterval)
+		if !u.fetchedAt.IsZero() {
+			u.logger.Warn("failed to fetch authorized keys (cached keys used)", "url", u.url, "fetched_at", u.fetchedAt, "retry_at", u.retryAt, "err", err)
+		}
+		return u.cachedKeys()
+	}
+	u.keys = keys
+	u.fetchedAt = time.Now()
+	u.retryAt = time.Time{}
+	u.fetchErr = nil
+	return keys, nil
+}
+
+// cachedKeys returns the last fetched keys or the error of the last fetch when never fetched. u.mu should be locked.
+func (u *authorizedKeysURL) cachedKeys() ([]authorizedKey, error) {
+	if u.fetchedAt.IsZero() {
+		return nil, u.fetchErr
+	}
+	return u.keys, nil
+}
+
+func (u *authorizedKeysURL) fetch() ([]authorizedKey, error) {
+	res, err := u.client.Get(u.url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status: %s", u.url, res.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, authorizedKeysURLMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > authorizedKeysURLMaxSize {
+		return nil, fmt.Errorf("%s: authorized keys larger than %d bytes", u.url, authorizedKeysURLMaxSize)
+	}
+	return parseAuthorizedKeys(b), nil
+}
+
+func (u *authorizedKeysURL) String() string {
+	return u.url
+}
+
+// isAuthorizedKeysURL returns true if the location of authorized_keys is an HTTP(S) URL rather than a file path
+func isAuthorizedKeysURL(location string) bool {
+	return strings.HasPrefix(location, "https://") || strings.HasPrefix(location, "http://")
+}
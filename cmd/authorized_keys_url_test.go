@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthorizedKeysURL(t *testing.T) {
+	signer, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	var requests atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	}))
+	defer server.Close()
+	address := startServer(t, "--user", "john:@"+server.URL+"/john.keys", "--authorized-keys-url-ttl", "500ms")
+	// Not fetched on start
+	assert.Equal(t, int32(0), requests.Load())
+
+	dial := func() error {
+		client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+			User:            "john",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	}
+	assert.NoError(t, dial())
+	assert.NoError(t, dial())
+	// Cached
+	assert.Equal(t, int32(1), requests.Load())
+
+	failing.Store(true)
+	time.Sleep(600 * time.Millisecond)
+	// The cached keys are used on fetch errors
+	assert.NoError(t, dial())
+	assert.Equal(t, int32(2), requests.Load())
+	// Not fetched again until the retry time
+	assert.NoError(t, dial())
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestAuthorizedKeysURLFetchNotBlocking(t *testing.T) {
+	signer, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Write(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+			return
+		}
+		// The URL is down after the first request
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	source := &authorizedKeysURL{url: server.URL, client: server.Client(), ttl: time.Millisecond, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	keys, err := source.authorizedKeys()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		keys, err := source.authorizedKeys()
+		assert.NoError(t, err)
+		assert.Len(t, keys, 1)
+	}()
+	for requests.Load() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// The cached keys are used while fetching
+	keys, err = source.authorizedKeys()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	close(release)
+	<-done
+	// Not fetched again until the retry time
+	keys, err = source.authorizedKeys()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestAuthorizedKeysURLErrors(t *testing.T) {
+	var body []byte
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	defer server.Close()
+	newSource := func() *authorizedKeysURL {
+		return &authorizedKeysURL{url: server.URL, client: server.Client(), ttl: time.Minute, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	}
+
+	body = bytes.Repeat([]byte("#"), authorizedKeysURLMaxSize+1)
+	_, err := newSource().authorizedKeys()
+	assert.ErrorContains(t, err, "larger than")
+
+	body = nil
+	status = http.StatusNotFound
+	_, err = newSource().authorizedKeys()
+	assert.ErrorContains(t, err, "404")
+}
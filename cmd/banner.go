@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// bannerData is available in the banner template (e.g. "{{.User}}")
+type bannerData struct {
+	User          string
+	RemoteAddress string
+}
+
+// loadBanner returns ssh.ServerConfig.BannerCallback showing the banner file before authentication. The file is a text/template.
+func loadBanner(logger *slog.Logger, path string) (func(ssh.ConnMetadata) string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("banner").Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return func(metadata ssh.ConnMetadata) string {
+		var banner strings.Builder
+		if err := tmpl.Execute(&banner, bannerData{User: metadata.User(), RemoteAddress: metadata.RemoteAddr().String()}); err != nil {
+			logger.Error("failed to execute banner template", "path", path, "err", err)
+			return ""
+		}
+		return banner.String()
+	}, nil
+}
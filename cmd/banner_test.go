@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestBanner(t *testing.T) {
+	bannerPath := path.Join(t.TempDir(), "banner")
+	assert.NoError(t, os.WriteFile(bannerPath, []byte("Authorized access only\nuser: {{.User}}, from: {{.RemoteAddress}}\n"), 0644))
+	address := startServer(t, "--user", "john:mypass", "--banner", bannerPath)
+	var banners []string
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "john",
+		Auth:            []ssh.AuthMethod{ssh.Password("mypass")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback: func(message string) error {
+			banners = append(banners, message)
+			return nil
+		},
+	})
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.Len(t, banners, 1)
+	assert.Regexp(t, `^Authorized access only\nuser: john, from: 127\.0\.0\.1:\d+\n$`, banners[0])
+}
+
+func TestInvalidBanner(t *testing.T) {
+	bannerPath := path.Join(t.TempDir(), "banner")
+	assert.NoError(t, os.WriteFile(bannerPath, []byte("{{.User"), 0644))
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{"--user", "john:mypass", "--banner", bannerPath})
+	var stderrBuf bytes.Buffer
+	rootCmd.SetErr(&stderrBuf)
+	assert.Error(t, rootCmd.Execute())
+	assert.Contains(t, stderrBuf.String(), "failed to parse "+bannerPath)
+}
+
+func TestMotd(t *testing.T) {
+	motdPath := path.Join(t.TempDir(), "motd")
+	assert.NoError(t, os.WriteFile(motdPath, []byte("Welcome\nto handy-sshd\n"), 0644))
+	address := startServer(t, "--user", "john:mypass", "--motd", motdPath, "--shell", "sh")
+	client, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	assert.NoError(t, session.RequestPty("xterm", 100, 200, ssh.TerminalModes{}))
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	// stdin is not closed not to close the session before the output
+	stdin, err := session.StdinPipe()
+	assert.NoError(t, err)
+	assert.NoError(t, session.Shell())
+	_, err = stdin.Write([]byte("echo hello''world\rexit\r"))
+	assert.NoError(t, err)
+	assert.NoError(t, session.Wait())
+	assert.True(t, strings.HasPrefix(stdout.String(), "Welcome\r\nto handy-sshd\r\n"), stdout.String())
+	assert.Contains(t, stdout.String(), "helloworld")
+
+	// Not shown without pty
+	session, err = client.NewSession()
+	assert.NoError(t, err)
+	output, err := session.Output("echo hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(output))
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/spf13/pflag"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"strings"
+)
+
+// Flags not allowed in the config file
+var configFileExcludedFlags = []string{"config", "version", "help"}
+
+// applyConfigFile sets flags not specified in the command line to values in the YAML config file. Keys are long flag names (e.g. "kex-algorithms").
+func applyConfigFile(flags *pflag.FlagSet, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]yaml.Node
+	if err := yaml.NewDecoder(bytes.NewReader(b)).Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for name, node := range config {
+		f := flags.Lookup(name)
+		if f == nil || slices.Contains(configFileExcludedFlags, name) {
+			return fmt.Errorf("%s: unknown key: %s", path, name)
+		}
+		// The command line takes precedence
+		if f.Changed {
+			continue
+		}
+		var values []string
+		switch node.Kind {
+		case yaml.ScalarNode:
+			values = []string{node.Value}
+		case yaml.SequenceNode:
+			if !strings.HasSuffix(f.Value.Type(), "Slice") && !strings.HasSuffix(f.Value.Type(), "Array") {
+				return fmt.Errorf("%s: %s takes a single value", path, name)
+			}
+			if err := node.Decode(&values); err != nil {
+				return fmt.Errorf("%s: %s: %w", path, name, err)
+			}
+		default:
+			return fmt.Errorf("%s: invalid value of %s", path, name)
+		}
+		for _, value := range values {
+			if err := flags.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %s: %w", path, name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/nwtgck/handy-sshd"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"strings"
+)
+
+func hashPasswordCmd() *cobra.Command {
+	var algorithm string
+	hashPasswordCmd := cobra.Command{
+		Use:          "hash-password",
+		Short:        "Hash a password read from stdin for --user",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		Example: `# Type a password and press Enter
+handy-sshd hash-password
+
+# Use the hash (quoted not to expand "$")
+handy-sshd -u 'john:$2a$10$...'`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			password, err := readPassword(cmd)
+			if err != nil {
+				return err
+			}
+			if password == "" {
+				return errors.New("empty password")
+			}
+			hash, err := handy_sshd.HashPassword(algorithm, []byte(password))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), hash)
+			return nil
+		},
+	}
+	hashPasswordCmd.Flags().StringVarP(&algorithm, "algorithm", "a", handy_sshd.PasswordHashBcrypt, fmt.Sprintf("hash algorithm (%s)", strings.Join(handy_sshd.PasswordHashAlgorithms, ", ")))
+	return &hashPasswordCmd
+}
+
+// readPassword reads a line without echo when stdin is a terminal
+func readPassword(cmd *cobra.Command) (string, error) {
+	if f, ok := cmd.InOrStdin().(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(cmd.ErrOrStderr(), "Password: ")
+		password, err := term.ReadPassword(int(f.Fd()))
+		// The newline typed by the user is not echoed
+		fmt.Fprintln(cmd.ErrOrStderr())
+		return string(password), err
+	}
+	line, err := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
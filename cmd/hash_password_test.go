@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"github.com/nwtgck/handy-sshd"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashPassword(t *testing.T) {
+	for _, algorithm := range []string{"bcrypt", "argon2id", "sha512-crypt"} {
+		t.Run(algorithm, func(t *testing.T) {
+			rootCmd := RootCmd()
+			rootCmd.SetArgs([]string{"hash-password", "--algorithm", algorithm})
+			rootCmd.SetIn(strings.NewReader("mypass\n"))
+			var stdoutBuf bytes.Buffer
+			rootCmd.SetOut(&stdoutBuf)
+			assert.NoError(t, rootCmd.Execute())
+			hash := strings.TrimSuffix(stdoutBuf.String(), "\n")
+			assertPasswordHash(t, hash, "mypass")
+		})
+	}
+}
+
+func TestSha512CryptPassword(t *testing.T) {
+	// Generated by crypt(3) of glibc
+	assertPasswordHash(t, "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!")
+	assertPasswordHash(t, "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0", "This is just a test")
+}
+
+func TestShadowPasswordHashes(t *testing.T) {
+	// Generated by crypt(3) of libxcrypt
+	assertPasswordHash(t, "$1$saltsalt$6l6q78pgx7P4rrtE8mRi8/", "mypass")
+	assertPasswordHash(t, "$5$abc$HHlb8QMClR55.dRTU4JXNgHGkR1U6jlbNtlfDN528y0", "a")
+	assertPasswordHash(t, "$y$j9T$abcdefghijklmnop$lLbHPeMbpx4Zz.Af89L/4L9UGkb.3P.pK3DaNB5xNe2", "mypass")
+	// p = 2
+	assertPasswordHash(t, "$y$j8T..$abcd$ZGnz4eii4fs.1T1nkvJ50kMBHj4ZRsZyxyQIM6RFv85", "pw")
+	// t = 1
+	assertPasswordHash(t, "$y$j8T/.$abcd$QmZejy2OtBQ3VFdJBaul1vIKDxOuYYNjD.ODwWZm177", "pw")
+}
+
+func TestInvalidPasswordHash(t *testing.T) {
+	for _, hash := range []string{"$2a$10$invalid", "$argon2id$v=19$m=65536$salt$hash", "$6$", "$6$salt$short", "$1$salt$6l6q78pgx7P4rrtE8mRi8!", "$5$rounds=x$abc$HHlb8QMClR55.dRTU4JXNgHGkR1U6jlbNtlfDN528y0", "$y$j9T$", "$y$zzz$abcd$hash"} {
+		rootCmd := RootCmd()
+		rootCmd.SetArgs([]string{"--user", "john:{hash}" + hash})
+		var stderrBuf bytes.Buffer
+		rootCmd.SetErr(&stderrBuf)
+		assert.Error(t, rootCmd.Execute())
+		assert.Contains(t, stderrBuf.String(), `invalid password hash of user "john"`)
+	}
+}
+
+func TestPlainPasswordLikeHash(t *testing.T) {
+	// Taken for the plain password without the marker
+	for _, password := range []string{"$6$", "$1$saltsalt$6l6q78pgx7P4rrtE8mRi8/"} {
+		address := startServer(t, "--user", "john:"+password)
+		client, err := dialWithPassword(address, "john", password)
+		assert.NoError(t, err, password)
+		if err == nil {
+			client.Close()
+		}
+	}
+}
+
+func TestValidatePasswordHashWithoutComputing(t *testing.T) {
+	// Computing the hash with the max rounds takes minutes
+	start := time.Now()
+	assert.NoError(t, handy_sshd.ValidatePasswordHash("$6$rounds=999999999$saltstring$"+strings.Repeat("a", 86)))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestHashPasswordEmpty(t *testing.T) {
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{"hash-password"})
+	rootCmd.SetIn(strings.NewReader("\n"))
+	var stderrBuf bytes.Buffer
+	rootCmd.SetErr(&stderrBuf)
+	assert.Error(t, rootCmd.Execute())
+	assert.Equal(t, "Error: empty password\n", stderrBuf.String())
+}
+
+// assertPasswordHash asserts that the server with the hash accepts only the password
+func assertPasswordHash(t *testing.T, hash string, password string) {
+	rootCmd := RootCmd()
+	port := getAvailableTcpPort()
+	rootCmd.SetArgs([]string{"--port", strconv.Itoa(port), "--user", "john:{hash}" + hash})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		var stderrBuf bytes.Buffer
+		rootCmd.SetErr(&stderrBuf)
+		rootCmd.ExecuteContext(ctx)
+	}()
+	waitTCPServer(port)
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "john",
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	if err == nil {
+		client.Close()
+	}
+	for _, wrongPassword := range []string{"mywrongpassword", hash, ""} {
+		_, err = ssh.Dial("tcp", address, &ssh.ClientConfig{
+			User:            "john",
+			Auth:            []ssh.AuthMethod{ssh.Password(wrongPassword)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"bytes"
+	"github.com/creack/pty"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashPasswordFromTerminal(t *testing.T) {
+	ptmx, tty, err := pty.Open()
+	assert.NoError(t, err)
+	defer ptmx.Close()
+	defer tty.Close()
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{"hash-password"})
+	rootCmd.SetIn(tty)
+	rootCmd.SetErr(tty)
+	var stdoutBuf bytes.Buffer
+	rootCmd.SetOut(&stdoutBuf)
+	errChan := make(chan error)
+	go func() {
+		errChan <- rootCmd.Execute()
+	}()
+	// Type the password after the prompt
+	var terminal bytes.Buffer
+	buf := make([]byte, 1024)
+	for !strings.Contains(terminal.String(), "Password: ") {
+		n, err := ptmx.Read(buf)
+		assert.NoError(t, err)
+		terminal.Write(buf[:n])
+	}
+	// Wait for echo to be disabled after the prompt
+	time.Sleep(100 * time.Millisecond)
+	_, err = ptmx.Write([]byte("mypass\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, <-errChan)
+	tty.Close()
+	hash := strings.TrimSuffix(stdoutBuf.String(), "\n")
+	assertPasswordHash(t, hash, "mypass")
+	// The password is not echoed
+	rest, _ := io.ReadAll(ptmx)
+	terminal.Write(rest)
+	assert.NotContains(t, terminal.String(), "mypass")
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/nwtgck/handy-sshd"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+	"os"
+	"path/filepath"
+)
+
+// defaultStateDir returns $XDG_STATE_HOME/handy-sshd or ~/.local/state/handy-sshd
+func defaultStateDir() (string, error) {
+	if stateHome := os.Getenv("XDG_STATE_HOME"); stateHome != "" {
+		return filepath.Join(stateHome, "handy-sshd"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", "handy-sshd"), nil
+}
+
+// loadOrGenerateHostKeys loads host keys in the state directory. Keys are generated and stored on first use.
+func loadOrGenerateHostKeys(logger *slog.Logger, stateDir string, keyTypes []string) ([]ssh.Signer, error) {
+	if stateDir == "" {
+		var err error
+		stateDir, err = defaultStateDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var signers []ssh.Signer
+	for _, keyType := range keyTypes {
+		signer, generated, err := loadOrGenerateHostKey(stateDir, keyType)
+		if err != nil {
+			return nil, err
+		}
+		if generated {
+			logger.Info("host key generated", "type", keyType, "dir", stateDir)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// loadOrGenerateHostKey loads the host key in the state directory. The key is generated and stored on first use.
+func loadOrGenerateHostKey(stateDir string, keyType string) (signer ssh.Signer, generated bool, err error) {
+	keyPath := filepath.Join(stateDir, fmt.Sprintf("ssh_host_%s_key", keyType))
+	if pemBytes, err := os.ReadFile(keyPath); err == nil {
+		signer, err := ssh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to parse %s: %w", keyPath, err)
+		}
+		return signer, false, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, false, err
+	}
+	privateKey, err := handy_sshd.GeneratePrivateKey(keyType, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	pemBlock, err := ssh.MarshalPrivateKey(privateKey, "handy-sshd host key")
+	if err != nil {
+		return nil, false, err
+	}
+	signer, err = ssh.NewSignerFromSigner(privateKey)
+	if err != nil {
+		return nil, false, err
+	}
+	// Write to a temporary file and link it not to overwrite the key generated by another process at the same time
+	tempFile, err := os.CreateTemp(stateDir, ".ssh_host_key-*")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(pem.EncodeToMemory(pemBlock)); err != nil {
+		tempFile.Close()
+		return nil, false, err
+	}
+	if err := tempFile.Close(); err != nil {
+		return nil, false, err
+	}
+	if err := os.Link(tempFile.Name(), keyPath); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return loadOrGenerateHostKey(stateDir, keyType)
+		}
+		return nil, false, err
+	}
+	if err := os.WriteFile(keyPath+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		return nil, false, err
+	}
+	return signer, true, nil
+}
+
+// loadPrivateKeyFile loads a private key in PEM (PKCS#1, PKCS#8 or SEC1) or OpenSSH format. passphrase is called only when the key is encrypted.
+func loadPrivateKeyFile(path string, passphrase func() ([]byte, error)) (ssh.Signer, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	var passphraseMissingError *ssh.PassphraseMissingError
+	if errors.As(err, &passphraseMissingError) {
+		p, err := passphrase()
+		if err != nil {
+			return nil, fmt.Errorf("%s is encrypted: %w", path, err)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		return signer, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// keyPassphrase returns a function to get the passphrase from the environment variable or the file. flagPrefix is used in the error message (e.g. "--host-key-passphrase").
+func keyPassphrase(passphraseEnv string, passphraseFile string, flagPrefix string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if passphraseEnv != "" {
+			passphrase, ok := os.LookupEnv(passphraseEnv)
+			if !ok {
+				return nil, fmt.Errorf("environment variable %s not set", passphraseEnv)
+			}
+			return []byte(passphrase), nil
+		}
+		if passphraseFile != "" {
+			passphrase, err := os.ReadFile(passphraseFile)
+			if err != nil {
+				return nil, err
+			}
+			return bytes.TrimRight(passphrase, "\r\n"), nil
+		}
+		return nil, fmt.Errorf("passphrase not specified (%s-env or %s-file)", flagPrefix, flagPrefix)
+	}
+}
+
+// loadHostCertificate loads an OpenSSH host certificate and returns the host key of the certified public key
+func loadHostCertificate(path string, hostKeys []ssh.Signer) (ssh.Signer, *ssh.Certificate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return nil, nil, fmt.Errorf("%s is not a host certificate", path)
+	}
+	for _, hostKey := range hostKeys {
+		if bytes.Equal(hostKey.PublicKey().Marshal(), cert.Key.Marshal()) {
+			return hostKey, cert, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no host key for %s (fingerprint: %s)", path, ssh.FingerprintSHA256(cert.Key))
+}
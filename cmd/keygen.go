@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/nwtgck/handy-sshd"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type keygenFlagType struct {
+	keyType string
+	bits    int
+	file    string
+	comment string
+}
+
+func keygenCmd() *cobra.Command {
+	var flag keygenFlagType
+	keygenCmd := cobra.Command{
+		Use:          "keygen",
+		Short:        "Generate a key pair in OpenSSH format",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		Example: `# Generate an Ed25519 host key (ssh_host_ed25519_key and ssh_host_ed25519_key.pub)
+handy-sshd keygen -f ssh_host_ed25519_key
+
+# Generate a 4096-bit RSA key
+handy-sshd keygen -t rsa -b 4096 -f ssh_host_rsa_key`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return keygenRunE(cmd, &flag)
+		},
+	}
+	keygenCmd.Flags().StringVarP(&flag.keyType, "type", "t", handy_sshd.KeyTypeEd25519, fmt.Sprintf("key type (%s)", strings.Join(handy_sshd.KeyTypes, ", ")))
+	keygenCmd.Flags().IntVarP(&flag.bits, "bits", "b", 0, fmt.Sprintf("key size: 256, 384 or 521 for ecdsa (default 256), 2048 or more for rsa (default %d)", handy_sshd.DefaultRsaBits))
+	keygenCmd.Flags().StringVarP(&flag.file, "file", "f", "", "output private key file (the public key is written to <file>.pub)")
+	keygenCmd.Flags().StringVarP(&flag.comment, "comment", "C", "", "comment")
+	keygenCmd.MarkFlagRequired("file")
+	keygenCmd.AddCommand(keygenSignHostCmd())
+	return &keygenCmd
+}
+
+type keygenSignHostFlagType struct {
+	caKeyFile        string
+	caPassphraseEnv  string
+	caPassphraseFile string
+	identity         string
+	principals       []string
+	validity         string
+	serial           uint64
+}
+
+func keygenSignHostCmd() *cobra.Command {
+	var flag keygenSignHostFlagType
+	signHostCmd := cobra.Command{
+		Use:          "sign-host <host public key file>...",
+		Short:        "Issue OpenSSH host certificates signed by a CA key",
+		SilenceUsage: true,
+		Args:         cobra.MinimumNArgs(1),
+		Example: `# Issue ssh_host_ed25519_key-cert.pub valid for 52 weeks
+handy-sshd keygen sign-host --ca ./host_ca -n myhost.example.com -V 52w ssh_host_ed25519_key.pub`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return keygenSignHostRunE(cmd, args, &flag)
+		},
+	}
+	signHostCmd.Flags().StringVarP(&flag.caKeyFile, "ca", "", "", "CA private key file")
+	signHostCmd.Flags().StringVarP(&flag.caPassphraseEnv, "ca-passphrase-env", "", "", "environment variable name of the passphrase of the encrypted CA key")
+	signHostCmd.Flags().StringVarP(&flag.caPassphraseFile, "ca-passphrase-file", "", "", "file containing the passphrase of the encrypted CA key")
+	signHostCmd.Flags().StringVarP(&flag.identity, "identity", "I", "", "key identity (default the first principal)")
+	signHostCmd.Flags().StringSliceVarP(&flag.principals, "principals", "n", nil, "host names and addresses the certificate is valid for (e.g. myhost.example.com,192.0.2.1)")
+	signHostCmd.Flags().StringVarP(&flag.validity, "validity", "V", "", `validity period from now (e.g. "720h", "30d", "52w") (default forever)`)
+	signHostCmd.Flags().Uint64VarP(&flag.serial, "serial", "z", 0, "serial number")
+	signHostCmd.MarkFlagRequired("ca")
+	signHostCmd.MarkFlagRequired("principals")
+	return &signHostCmd
+}
+
+func keygenSignHostRunE(cmd *cobra.Command, args []string, flag *keygenSignHostFlagType) error {
+	validBefore := uint64(ssh.CertTimeInfinity)
+	now := time.Now()
+	if flag.validity != "" {
+		validity, err := parseValidity(flag.validity)
+		if err != nil {
+			return err
+		}
+		validBefore = uint64(now.Add(validity).Unix())
+	}
+	caKey, err := loadPrivateKeyFile(flag.caKeyFile, keyPassphrase(flag.caPassphraseEnv, flag.caPassphraseFile, "--ca-passphrase"))
+	if err != nil {
+		return err
+	}
+	identity := flag.identity
+	if identity == "" {
+		identity = flag.principals[0]
+	}
+	for _, publicKeyFile := range args {
+		b, err := os.ReadFile(publicKeyFile)
+		if err != nil {
+			return err
+		}
+		publicKey, comment, _, _, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", publicKeyFile, err)
+		}
+		if _, ok := publicKey.(*ssh.Certificate); ok {
+			return fmt.Errorf("%s is a certificate", publicKeyFile)
+		}
+		cert := &ssh.Certificate{
+			Key:             publicKey,
+			Serial:          flag.serial,
+			CertType:        ssh.HostCert,
+			KeyId:           identity,
+			ValidPrincipals: flag.principals,
+			ValidAfter:      uint64(now.Unix()),
+			ValidBefore:     validBefore,
+		}
+		if err := cert.SignCert(rand.Reader, caKey); err != nil {
+			return err
+		}
+		certFile := strings.TrimSuffix(publicKeyFile, ".pub") + "-cert.pub"
+		if err := os.WriteFile(certFile, handy_sshd.MarshalAuthorizedKeyWithComment(cert, comment), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Certificate: %s (id: %q, principals: %s)\n", certFile, identity, strings.Join(flag.principals, ","))
+	}
+	return nil
+}
+
+// parseValidity parses a duration in time.ParseDuration() format or a number of days ("30d") or weeks ("52w")
+func parseValidity(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			i, err := strconv.Atoi(n)
+			if err != nil || i <= 0 {
+				return 0, fmt.Errorf("invalid validity: %s", s)
+			}
+			return time.Duration(i) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid validity: %s", s)
+	}
+	return d, nil
+}
+
+func keygenRunE(cmd *cobra.Command, flag *keygenFlagType) error {
+	publicKeyFile := flag.file + ".pub"
+	for _, file := range []string{flag.file, publicKeyFile} {
+		if _, err := os.Stat(file); err == nil {
+			return fmt.Errorf("%s already exists", file)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	privateKeyPem, authorizedKey, err := handy_sshd.GenerateKeyPair(flag.keyType, flag.bits, flag.comment)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(flag.file, privateKeyPem, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(publicKeyFile, authorizedKey, 0644); err != nil {
+		return err
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(authorizedKey)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Private key: %s\n", flag.file)
+	fmt.Fprintf(cmd.OutOrStdout(), "Public key: %s\n", publicKeyFile)
+	fmt.Fprintf(cmd.OutOrStdout(), "Fingerprint: %s\n", ssh.FingerprintSHA256(publicKey))
+	return nil
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeygen(t *testing.T) {
+	for _, tc := range []struct {
+		args        []string
+		keyType     string
+		checkPublic func(t *testing.T, publicKey ssh.PublicKey)
+	}{
+		{args: nil, keyType: ssh.KeyAlgoED25519},
+		{args: []string{"-t", "ecdsa"}, keyType: ssh.KeyAlgoECDSA256},
+		{args: []string{"-t", "ecdsa", "-b", "384"}, keyType: ssh.KeyAlgoECDSA384},
+		{args: []string{"-t", "ecdsa", "-b", "521"}, keyType: ssh.KeyAlgoECDSA521},
+		{args: []string{"-t", "rsa"}, keyType: ssh.KeyAlgoRSA, checkPublic: func(t *testing.T, publicKey ssh.PublicKey) {
+			assert.Equal(t, 3072, publicKey.(ssh.CryptoPublicKey).CryptoPublicKey().(*rsa.PublicKey).N.BitLen())
+		}},
+		{args: []string{"-t", "rsa", "-b", "2048"}, keyType: ssh.KeyAlgoRSA, checkPublic: func(t *testing.T, publicKey ssh.PublicKey) {
+			assert.Equal(t, 2048, publicKey.(ssh.CryptoPublicKey).CryptoPublicKey().(*rsa.PublicKey).N.BitLen())
+		}},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			keyPath := path.Join(t.TempDir(), "mykey")
+			rootCmd := RootCmd()
+			rootCmd.SetArgs(append([]string{"keygen", "-f", keyPath, "-C", "john@example.com"}, tc.args...))
+			var stdoutBuf bytes.Buffer
+			rootCmd.SetOut(&stdoutBuf)
+			assert.NoError(t, rootCmd.Execute())
+
+			privateKeyPem, err := os.ReadFile(keyPath)
+			assert.NoError(t, err)
+			signer, err := ssh.ParsePrivateKey(privateKeyPem)
+			assert.NoError(t, err)
+			authorizedKey, err := os.ReadFile(keyPath + ".pub")
+			assert.NoError(t, err)
+			publicKey, comment, _, _, err := ssh.ParseAuthorizedKey(authorizedKey)
+			assert.NoError(t, err)
+			assert.Equal(t, "john@example.com", comment)
+			assert.Equal(t, tc.keyType, publicKey.Type())
+			assert.Equal(t, signer.PublicKey().Marshal(), publicKey.Marshal())
+			if tc.checkPublic != nil {
+				tc.checkPublic(t, publicKey)
+			}
+			assert.Contains(t, stdoutBuf.String(), ssh.FingerprintSHA256(publicKey))
+
+			stat, err := os.Stat(keyPath)
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+		})
+	}
+}
+
+func TestKeygenInvalidKeySize(t *testing.T) {
+	for _, args := range [][]string{{"-t", "ecdsa", "-b", "512"}, {"-t", "rsa", "-b", "1024"}, {"-t", "dsa"}} {
+		keyPath := path.Join(t.TempDir(), "mykey")
+		rootCmd := RootCmd()
+		rootCmd.SetArgs(append([]string{"keygen", "-f", keyPath}, args...))
+		rootCmd.SetErr(&bytes.Buffer{})
+		assert.Error(t, rootCmd.Execute())
+		_, err := os.Stat(keyPath)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+}
+
+func TestKeygenExistingFile(t *testing.T) {
+	keyPath := path.Join(t.TempDir(), "mykey")
+	assert.NoError(t, os.WriteFile(keyPath, []byte("existing"), 0600))
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{"keygen", "-f", keyPath})
+	var stderrBuf bytes.Buffer
+	rootCmd.SetErr(&stderrBuf)
+	assert.Error(t, rootCmd.Execute())
+	assert.Equal(t, "Error: "+keyPath+" already exists\n", stderrBuf.String())
+	b, err := os.ReadFile(keyPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "existing", string(b))
+}
+
+func TestKeygenSignHost(t *testing.T) {
+	dir := t.TempDir()
+	caPem, err := ssh.MarshalPrivateKeyWithPassphrase(generateEcdsaKey(t), "", []byte("mypassphrase"))
+	assert.NoError(t, err)
+	caSigner, err := ssh.ParsePrivateKeyWithPassphrase(pem.EncodeToMemory(caPem), []byte("mypassphrase"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path.Join(dir, "host_ca"), pem.EncodeToMemory(caPem), 0600))
+	hostSigner, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path.Join(dir, "host_key.pub"), ssh.MarshalAuthorizedKey(hostSigner.PublicKey()), 0644))
+	t.Setenv("HANDY_SSHD_TEST_PASSPHRASE", "mypassphrase")
+
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{
+		"keygen", "sign-host", "--ca", path.Join(dir, "host_ca"), "--ca-passphrase-env", "HANDY_SSHD_TEST_PASSPHRASE",
+		"-I", "myhost", "-n", "myhost.example.com,192.0.2.1", "-V", "2w", "-z", "42", path.Join(dir, "host_key.pub"),
+	})
+	rootCmd.SetOut(&bytes.Buffer{})
+	assert.NoError(t, rootCmd.Execute())
+
+	b, err := os.ReadFile(path.Join(dir, "host_key-cert.pub"))
+	assert.NoError(t, err)
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	assert.NoError(t, err)
+	cert := publicKey.(*ssh.Certificate)
+	assert.Equal(t, uint32(ssh.HostCert), cert.CertType)
+	assert.Equal(t, "myhost", cert.KeyId)
+	assert.Equal(t, uint64(42), cert.Serial)
+	assert.Equal(t, []string{"myhost.example.com", "192.0.2.1"}, cert.ValidPrincipals)
+	assert.Equal(t, hostSigner.PublicKey().Marshal(), cert.Key.Marshal())
+	assert.Equal(t, caSigner.PublicKey().Marshal(), cert.SignatureKey.Marshal())
+	assert.InDelta(t, 14*24*time.Hour.Seconds(), float64(cert.ValidBefore-cert.ValidAfter), 1)
+	certChecker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return bytes.Equal(auth.Marshal(), caSigner.PublicKey().Marshal())
+		},
+	}
+	assert.NoError(t, certChecker.CheckHostKey("myhost.example.com:22", nil, cert))
+	assert.Error(t, certChecker.CheckHostKey("other.example.com:22", nil, cert))
+}
+
+func TestParseValidity(t *testing.T) {
+	for s, expected := range map[string]time.Duration{"90m": 90 * time.Minute, "720h": 720 * time.Hour, "30d": 30 * 24 * time.Hour, "52w": 52 * 7 * 24 * time.Hour} {
+		d, err := parseValidity(s)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, d)
+	}
+	for _, s := range []string{"", "w", "-1d", "1y", "0h"} {
+		_, err := parseValidity(s)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol (ref: https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt)
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtocolV1Prefix = "PROXY "
+	// The longest v1 header including CRLF
+	proxyProtocolV1MaxLength = 107
+	proxyProtocolTimeout     = 10 * time.Second
+)
+
+// proxyProtocolConn is a connection whose remote address is the client address in the PROXY protocol header
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// readProxyProtocolHeader reads the PROXY protocol v1 or v2 header. The remote address of the returned connection is the client's.
+// The address of the proxy is kept for health checks of the proxy (LOCAL of v2 and UNKNOWN of v1) and address families other than TCP.
+func readProxyProtocolHeader(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout)); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	// Headers of both versions are longer than the signature
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+	var remoteAddr net.Addr
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		remoteAddr, err = readProxyProtocolV2(reader)
+	} else if bytes.HasPrefix(signature, []byte(proxyProtocolV1Prefix)) {
+		remoteAddr, err = readProxyProtocolV1(reader)
+	} else {
+		err = fmt.Errorf("no PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if remoteAddr == nil {
+		remoteAddr = conn.RemoteAddr()
+	}
+	return &proxyProtocolConn{Conn: conn, reader: reader, remoteAddr: remoteAddr}, nil
+}
+
+// readProxyProtocolV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n"
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, fmt.Errorf("too long PROXY protocol v1 header")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY protocol v1 header: %w", err)
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header: %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid source address in PROXY protocol v1 header: %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port in PROXY protocol v1 header: %s", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 reads a binary header
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol v2 header: %w", err)
+	}
+	versionCommand := header[12]
+	family := header[13]
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol v2 addresses: %w", err)
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %d", versionCommand>>4)
+	}
+	switch versionCommand & 0xf {
+	case 0x0:
+		// LOCAL
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command: %d", versionCommand&0xf)
+	}
+	var ipLen int
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21:
+		// TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	// Source address, destination address, source port and destination port followed by TLVs
+	if len(addresses) < 2*ipLen+4 {
+		return nil, fmt.Errorf("too short PROXY protocol v2 addresses")
+	}
+	ip := net.IP(addresses[:ipLen])
+	port := binary.BigEndian.Uint16(addresses[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
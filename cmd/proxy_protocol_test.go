@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+// dialWithProxyProtocol connects to the server after sending the PROXY protocol header like a proxy
+func dialWithProxyProtocol(address string, header []byte, user string, auth ssh.AuthMethod) (*ssh.Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+func proxyProtocolV2Header(ip net.IP, port uint16) []byte {
+	family := byte(0x21)
+	if ip.To4() != nil {
+		ip = ip.To4()
+		family = 0x11
+	}
+	addresses := append(append([]byte{}, ip...), make([]byte, len(ip))...)
+	addresses = binary.BigEndian.AppendUint16(addresses, port)
+	addresses = binary.BigEndian.AppendUint16(addresses, 22)
+	header := append(append([]byte{}, proxyProtocolV2Signature...), 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass", "--proxy-protocol", "--allow-from", "192.0.2.0/24", "--deny-from", "192.0.2.128/25")
+	for _, header := range [][]byte{
+		[]byte("PROXY TCP4 192.0.2.10 127.0.0.1 50000 22\r\n"),
+		proxyProtocolV2Header(net.ParseIP("192.0.2.10"), 50000),
+	} {
+		client, err := dialWithProxyProtocol(address, header, "john", ssh.Password("mypass"))
+		assert.NoError(t, err, string(header))
+		if err == nil {
+			assertExec(t, client)
+			client.Close()
+		}
+	}
+	for _, header := range [][]byte{
+		// Denied client address
+		[]byte("PROXY TCP4 192.0.2.200 127.0.0.1 50000 22\r\n"),
+		proxyProtocolV2Header(net.ParseIP("192.0.2.200"), 50000),
+		// Not allowed client address
+		[]byte("PROXY TCP6 2001:db8::1 ::1 50000 22\r\n"),
+		// The address of the proxy is not allowed
+		[]byte("PROXY UNKNOWN\r\n"),
+		// Without header
+		[]byte("SSH-2.0-Go\r\n"),
+	} {
+		_, err := dialWithProxyProtocol(address, header, "john", ssh.Password("mypass"))
+		assert.Error(t, err, string(header))
+	}
+}
+
+func TestProxyProtocolFrom(t *testing.T) {
+	header := []byte("PROXY TCP4 192.0.2.10 127.0.0.1 50000 22\r\n")
+	address := startServer(t, "--user", "john:mypass", "--proxy-protocol", "--proxy-protocol-from", "127.0.0.0/8")
+	client, err := dialWithProxyProtocol(address, header, "john", ssh.Password("mypass"))
+	assert.NoError(t, err)
+	if err == nil {
+		client.Close()
+	}
+	address = startServer(t, "--user", "john:mypass", "--proxy-protocol", "--proxy-protocol-from", "10.0.0.0/8")
+	// Refused before reading the header
+	conn, err := net.Dial("tcp", address)
+	assert.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	conn.Close()
+}
+
+func TestProxyProtocolUsersFileFrom(t *testing.T) {
+	usersFilePath := path.Join(t.TempDir(), "users.yaml")
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte(`
+users:
+  - name: john
+    password: mypass
+    from: ["192.0.2.0/24"]
+`), 0600))
+	address := startUsersFileServer(t, usersFilePath, "--proxy-protocol")
+	client, err := dialWithProxyProtocol(address, []byte("PROXY TCP4 192.0.2.10 127.0.0.1 50000 22\r\n"), "john", ssh.Password("mypass"))
+	assert.NoError(t, err)
+	if err == nil {
+		client.Close()
+	}
+	_, err = dialWithProxyProtocol(address, []byte("PROXY TCP4 198.51.100.10 127.0.0.1 50000 22\r\n"), "john", ssh.Password("mypass"))
+	assert.Error(t, err)
+}
+
+func TestProxyProtocolUserFrom(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass", "--user-from", "john:192.0.2.0/24", "--proxy-protocol")
+	client, err := dialWithProxyProtocol(address, []byte("PROXY TCP4 192.0.2.10 127.0.0.1 50000 22\r\n"), "john", ssh.Password("mypass"))
+	assert.NoError(t, err)
+	if err == nil {
+		client.Close()
+	}
+	_, err = dialWithProxyProtocol(address, []byte("PROXY TCP4 198.51.100.10 127.0.0.1 50000 22\r\n"), "john", ssh.Password("mypass"))
+	assert.Error(t, err)
+}
+
+func TestProxyProtocolAuthorizedKeyFrom(t *testing.T) {
+	signer, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	authorizedKeysPath := path.Join(t.TempDir(), "authorized_keys")
+	assert.NoError(t, os.WriteFile(authorizedKeysPath, []byte(authorizedKeyLine(`from="192.0.2.0/24"`, signer)), 0600))
+	address := startServer(t, "--user", "john:@"+authorizedKeysPath, "--proxy-protocol")
+	client, err := dialWithProxyProtocol(address, []byte("PROXY TCP4 192.0.2.10 127.0.0.1 50000 22\r\n"), "john", ssh.PublicKeys(signer))
+	assert.NoError(t, err)
+	if err == nil {
+		client.Close()
+	}
+	_, err = dialWithProxyProtocol(address, []byte("PROXY TCP4 198.51.100.10 127.0.0.1 50000 22\r\n"), "john", ssh.PublicKeys(signer))
+	assert.Error(t, err)
+}
+
+func TestInvalidProxyProtocolFrom(t *testing.T) {
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{"--user", "john:mypass", "--proxy-protocol", "--proxy-protocol-from", "10.0.0.0/33"})
+	assert.Error(t, rootCmd.Execute())
+}
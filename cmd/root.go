@@ -1,16 +1,21 @@
 package cmd
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"fmt"
 	"github.com/nwtgck/handy-sshd"
 	"github.com/nwtgck/handy-sshd/version"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slices"
 	"golang.org/x/exp/slog"
 	"net"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type flagType struct {
@@ -21,6 +26,38 @@ type flagType struct {
 	sshUnixSocket string
 	sshShell      string
 	sshUsers      []string
+	usersFile     string
+	systemUsers   bool
+	authCommand   string
+	authUrl       string
+	// authorized_keys files for all users
+	authorizedKeysFiles    []string
+	authorizedKeysURLTTL   time.Duration
+	trustedUserCAKeysFiles []string
+	hostKeyFiles           []string
+	hostCertificateFiles   []string
+	hostKeyPassphraseEnv   string
+	hostKeyPassphraseFile  string
+	stateDir               string
+	hostKeyTypes           []string
+	maxAuthTries           int
+	authFailuresLimit      int
+	authFailuresWindow     time.Duration
+	authBanDuration        time.Duration
+	allowFrom              []string
+	denyFrom               []string
+	userFrom               []string
+	proxyProtocol          bool
+	proxyProtocolFrom      []string
+	configFile             string
+	algorithmsPreset       string
+	kexAlgorithms          []string
+	ciphers                []string
+	macs                   []string
+	hostKeyAlgorithms      []string
+	bannerFile             string
+	motdFile               string
+	closeGracePeriod       time.Duration
 
 	allowTcpipForward       bool
 	allowDirectTcpip        bool
@@ -35,9 +72,89 @@ type permissionFlagType = struct {
 	flagPtr *bool
 }
 
+// Prefix of password hashes in --user (e.g. "john:{hash}$2a$10$...")
+const passwordHashMarker = "{hash}"
+
 type sshUser struct {
 	name     string
 	password string
+	// The password is a hash supported by handy_sshd.VerifyPassword()
+	passwordHashed bool
+	// (e.g. "john:@/path/to/authorized_keys")
+	authorizedKeysSources []authorizedKeysSource
+	forceCommand          string
+	// "NAME=value"
+	environment []string
+	// Permission names replacing the server-wide permissions (nil means the server-wide permissions and empty means nothing allowed)
+	allowedPermissions []string
+	// TOTP secret required as the second factor
+	totpSecret []byte
+	// Chains of authentication methods (e.g. [["publickey", "password"]])
+	authenticationMethods [][]string
+	// Local account of --system-users
+	account *systemAccount
+	// OS user which sessions run as
+	runAs string
+	// Source addresses in the format of from="..." of authorized_keys
+	from string
+}
+
+// checkPassword compares the password with the password hash or the plain password in constant time
+func (u *sshUser) checkPassword(password []byte) bool {
+	if u.passwordHashed {
+		return handy_sshd.VerifyPassword(u.password, password)
+	}
+	// Compare digests not to leak the length of the password
+	expected := sha256.Sum256([]byte(u.password))
+	actual := sha256.Sum256(password)
+	return subtle.ConstantTimeCompare(expected[:], actual[:]) == 1
+}
+
+// permissions applies the settings of the user to the permissions of the authentication method. The force command of the user takes precedence as ForceCommand of OpenSSH does.
+func (u *sshUser) permissions(perms *ssh.Permissions) *ssh.Permissions {
+	if u.forceCommand == "" && len(u.environment) == 0 && u.allowedPermissions == nil && u.account == nil && u.runAs == "" {
+		return perms
+	}
+	if perms == nil {
+		perms = &ssh.Permissions{}
+	}
+	if perms.CriticalOptions == nil {
+		perms.CriticalOptions = map[string]string{}
+	}
+	if perms.Extensions == nil {
+		perms.Extensions = map[string]string{}
+	}
+	if u.forceCommand != "" {
+		perms.CriticalOptions[handy_sshd.CriticalOptionForceCommand] = u.forceCommand
+	}
+	if len(u.environment) != 0 {
+		environment := strings.Join(u.environment, "\n")
+		// Variables of the authentication method override the user's
+		if e, ok := perms.Extensions[handy_sshd.ExtensionEnvironment]; ok {
+			environment += "\n" + e
+		}
+		perms.Extensions[handy_sshd.ExtensionEnvironment] = environment
+	}
+	if u.allowedPermissions != nil {
+		perms.Extensions[handy_sshd.ExtensionPermissions] = strings.Join(u.allowedPermissions, ",")
+	}
+	if u.runAs != "" {
+		perms.Extensions[handy_sshd.ExtensionUser] = u.runAs
+	}
+	if u.account != nil {
+		if u.account.shell != "" {
+			perms.Extensions[handy_sshd.ExtensionShell] = u.account.shell
+		}
+		if u.account.homeDirectory != "" {
+			perms.Extensions[handy_sshd.ExtensionHomeDirectory] = u.account.homeDirectory
+		}
+	}
+	return perms
+}
+
+// requiresNoAuth returns true when none of password, authorized keys, TOTP secret and authentication methods is specified (e.g. "john:"). System users always require authentication.
+func (u *sshUser) requiresNoAuth() bool {
+	return u.account == nil && u.password == "" && len(u.authorizedKeysSources) == 0 && u.totpSecret == nil && u.authenticationMethods == nil
 }
 
 func init() {
@@ -47,12 +164,12 @@ func init() {
 func RootCmd() *cobra.Command {
 	var flag flagType
 	allPermissionFlags := []permissionFlagType{
-		{name: "tcpip-forward", flagPtr: &flag.allowTcpipForward},
-		{name: "direct-tcpip", flagPtr: &flag.allowDirectTcpip},
-		{name: "execute", flagPtr: &flag.allowExecute},
-		{name: "sftp", flagPtr: &flag.allowSftp},
-		{name: "streamlocal-forward", flagPtr: &flag.allowStreamlocalForward},
-		{name: "direct-streamlocal", flagPtr: &flag.allowDirectStreamlocal},
+		{name: handy_sshd.PermissionTcpipForward, flagPtr: &flag.allowTcpipForward},
+		{name: handy_sshd.PermissionDirectTcpip, flagPtr: &flag.allowDirectTcpip},
+		{name: handy_sshd.PermissionExecute, flagPtr: &flag.allowExecute},
+		{name: handy_sshd.PermissionSftp, flagPtr: &flag.allowSftp},
+		{name: handy_sshd.PermissionStreamlocalForward, flagPtr: &flag.allowStreamlocalForward},
+		{name: handy_sshd.PermissionDirectStreamlocal, flagPtr: &flag.allowDirectStreamlocal},
 	}
 	rootCmd := cobra.Command{
 		Use:          os.Args[0],
@@ -65,6 +182,9 @@ handy-sshd -u john:mypass
 # Listen on 22 and accept the user without password
 handy-sshd -p 22 -u john:
 
+# Accept user name "john" with public keys in authorized_keys
+handy-sshd -u john:@$HOME/.ssh/authorized_keys
+
 Permissions:
 All permissions are allowed by default.
 For example, specifying --allow-direct-tcpip and --allow-execute allows only them.`,
@@ -73,23 +193,58 @@ For example, specifying --allow-direct-tcpip and --allow-execute allows only the
 		},
 	}
 
-	rootCmd.PersistentFlags().BoolVarP(&flag.showsVersion, "version", "v", false, "show version")
-	rootCmd.PersistentFlags().StringVarP(&flag.sshHost, "host", "", "", "SSH server host to listen (e.g. 127.0.0.1)")
-	rootCmd.PersistentFlags().Uint16VarP(&flag.sshPort, "port", "p", 2222, "port to listen")
+	rootCmd.Flags().BoolVarP(&flag.showsVersion, "version", "v", false, "show version")
+	rootCmd.Flags().StringVarP(&flag.sshHost, "host", "", "", "SSH server host to listen (e.g. 127.0.0.1)")
+	rootCmd.Flags().Uint16VarP(&flag.sshPort, "port", "p", 2222, "port to listen")
 	// NOTE: long name 'unix-socket' is from curl (ref: https://curl.se/docs/manpage.html)
-	rootCmd.PersistentFlags().StringVarP(&flag.sshUnixSocket, "unix-socket", "", "", "Unix domain socket to listen")
-	rootCmd.PersistentFlags().StringVarP(&flag.sshShell, "shell", "", "", "Shell")
-	//rootCmd.PersistentFlags().StringVar(&flag.dnsServer, "dns-server", "", "DNS server (e.g. 1.1.1.1:53)")
-	rootCmd.PersistentFlags().StringArrayVarP(&flag.sshUsers, "user", "u", nil, `SSH user name (e.g. "john:mypass")`)
+	rootCmd.Flags().StringVarP(&flag.sshUnixSocket, "unix-socket", "", "", "Unix domain socket to listen")
+	rootCmd.Flags().StringVarP(&flag.sshShell, "shell", "", "", "Shell")
+	//rootCmd.Flags().StringVar(&flag.dnsServer, "dns-server", "", "DNS server (e.g. 1.1.1.1:53)")
+	rootCmd.Flags().StringArrayVarP(&flag.sshUsers, "user", "u", nil, `SSH user name (e.g. "john:mypass", "john:{hash}$2a$10$...", "john:@/path/to/authorized_keys", "john:@https://example.com/john.keys")`)
+	rootCmd.Flags().StringVarP(&flag.usersFile, "users-file", "", "", "YAML file of users reloaded on change or SIGHUP")
+	rootCmd.Flags().BoolVarP(&flag.systemUsers, "system-users", "", false, "accept local accounts in /etc/passwd with passwords in /etc/shadow and ~/.ssh/authorized_keys")
+	rootCmd.Flags().StringVarP(&flag.authCommand, "auth-command", "", "", "command authenticating users not in --user and --users-file (exit 0 = allow, JSON on stdin)")
+	rootCmd.Flags().StringVarP(&flag.authUrl, "auth-url", "", "", "URL authenticating users not in --user and --users-file (200 = allow, JSON POST)")
+	rootCmd.Flags().DurationVarP(&flag.authorizedKeysURLTTL, "authorized-keys-url-ttl", "", 5*time.Minute, `cache duration of authorized_keys fetched from URLs (e.g. "john:@https://example.com/john.keys")`)
+	rootCmd.Flags().StringArrayVarP(&flag.authorizedKeysFiles, "authorized-keys", "", nil, "authorized_keys file accepted for all users")
+	rootCmd.Flags().StringArrayVarP(&flag.hostKeyFiles, "host-key", "", nil, "host private key file in PEM (PKCS#1, PKCS#8, SEC1) or OpenSSH format (keys in the state directory are not used)")
+	rootCmd.Flags().StringArrayVarP(&flag.hostCertificateFiles, "host-certificate", "", nil, "OpenSSH host certificate file of a host key (e.g. ssh_host_ed25519_key-cert.pub)")
+	rootCmd.Flags().StringVarP(&flag.hostKeyPassphraseEnv, "host-key-passphrase-env", "", "", "environment variable name of the passphrase of encrypted host keys")
+	rootCmd.Flags().StringVarP(&flag.hostKeyPassphraseFile, "host-key-passphrase-file", "", "", "file containing the passphrase of encrypted host keys")
+	rootCmd.Flags().StringVarP(&flag.stateDir, "state-dir", "", "", "directory to store generated host keys (default $XDG_STATE_HOME/handy-sshd or ~/.local/state/handy-sshd)")
+	rootCmd.Flags().StringSliceVarP(&flag.hostKeyTypes, "host-key-types", "", []string{"ed25519"}, fmt.Sprintf("types of host keys generated in the state directory (%s)", strings.Join(handy_sshd.KeyTypes, ", ")))
+	rootCmd.Flags().StringVarP(&flag.bannerFile, "banner", "", "", "file shown before authentication (template with {{.User}} and {{.RemoteAddress}})")
+	rootCmd.Flags().StringVarP(&flag.motdFile, "motd", "", "", "message of the day file shown in pty sessions")
+	rootCmd.Flags().DurationVarP(&flag.closeGracePeriod, "close-grace-period", "", 5*time.Second, "time from SIGHUP to SIGKILL sent to processes of sessions closed by clients")
+	rootCmd.Flags().StringVarP(&flag.configFile, "config", "", "", "YAML file of flags by long names (e.g. \"ciphers: [aes256-gcm@openssh.com]\") overridden by the command line")
+	rootCmd.Flags().StringVarP(&flag.algorithmsPreset, "algorithms-preset", "", "", fmt.Sprintf("preset of the algorithms below (%s)", strings.Join(algorithmsPresetNames(), ", ")))
+	rootCmd.Flags().StringSliceVarP(&flag.kexAlgorithms, "kex-algorithms", "", nil, "key exchange algorithms in preference order")
+	rootCmd.Flags().StringSliceVarP(&flag.ciphers, "ciphers", "", nil, "ciphers in preference order")
+	rootCmd.Flags().StringSliceVarP(&flag.macs, "macs", "", nil, "MAC algorithms in preference order")
+	rootCmd.Flags().StringSliceVarP(&flag.hostKeyAlgorithms, "host-key-algorithms", "", nil, "host key algorithms (e.g. ssh-ed25519, rsa-sha2-512, ssh-ed25519-cert-v01@openssh.com)")
+	rootCmd.Flags().StringSliceVarP(&flag.allowFrom, "allow-from", "", nil, "CIDR addresses of clients allowed to connect (e.g. 10.8.0.0/16)")
+	rootCmd.Flags().StringSliceVarP(&flag.denyFrom, "deny-from", "", nil, "CIDR addresses of clients refused (taking precedence over --allow-from)")
+	rootCmd.Flags().StringArrayVarP(&flag.userFrom, "user-from", "", nil, `source addresses of a user of --user in the format of from="..." of authorized_keys (e.g. "john:10.8.0.0/16,!10.8.5.*")`)
+	rootCmd.Flags().BoolVarP(&flag.proxyProtocol, "proxy-protocol", "", false, "require PROXY protocol v1/v2 headers and use the client addresses in them")
+	rootCmd.Flags().StringSliceVarP(&flag.proxyProtocolFrom, "proxy-protocol-from", "", nil, "CIDR addresses of proxies allowed to send PROXY protocol headers (default all)")
+	rootCmd.Flags().IntVarP(&flag.maxAuthTries, "max-auth-tries", "", 6, "maximum authentication attempts per connection (negative = unlimited)")
+	rootCmd.Flags().IntVarP(&flag.authFailuresLimit, "auth-failures-limit", "", 10, "failed authentications per source IP in --auth-failures-window before a ban (0 = no brute-force protection)")
+	rootCmd.Flags().DurationVarP(&flag.authFailuresWindow, "auth-failures-window", "", 10*time.Minute, "sliding window counting failed authentications")
+	rootCmd.Flags().DurationVarP(&flag.authBanDuration, "auth-ban-duration", "", 10*time.Minute, "duration of bans of source IPs")
+	rootCmd.Flags().StringArrayVarP(&flag.trustedUserCAKeysFiles, "trusted-user-ca-keys", "", nil, "CA public keys file trusted to sign user certificates (the principal is the user name)")
 
 	// Permission flags
-	rootCmd.PersistentFlags().BoolVarP(&flag.allowTcpipForward, "allow-tcpip-forward", "", false, "client can use remote forwarding (ssh -R)")
-	rootCmd.PersistentFlags().BoolVarP(&flag.allowDirectTcpip, "allow-direct-tcpip", "", false, "client can use local forwarding (ssh -L) and SOCKS proxy (ssh -D)")
-	rootCmd.PersistentFlags().BoolVarP(&flag.allowExecute, "allow-execute", "", false, "client can use shell/interactive shell")
-	rootCmd.PersistentFlags().BoolVarP(&flag.allowSftp, "allow-sftp", "", false, "client can use SFTP and SSHFS")
-	rootCmd.PersistentFlags().BoolVarP(&flag.allowStreamlocalForward, "allow-streamlocal-forward", "", false, "client can use Unix domain socket remote forwarding (ssh -R)")
-	rootCmd.PersistentFlags().BoolVarP(&flag.allowDirectStreamlocal, "allow-direct-streamlocal", "", false, "client can use Unix domain socket local forwarding (ssh -L)")
+	rootCmd.Flags().BoolVarP(&flag.allowTcpipForward, "allow-tcpip-forward", "", false, "client can use remote forwarding (ssh -R)")
+	rootCmd.Flags().BoolVarP(&flag.allowDirectTcpip, "allow-direct-tcpip", "", false, "client can use local forwarding (ssh -L) and SOCKS proxy (ssh -D)")
+	rootCmd.Flags().BoolVarP(&flag.allowExecute, "allow-execute", "", false, "client can use shell/interactive shell")
+	rootCmd.Flags().BoolVarP(&flag.allowSftp, "allow-sftp", "", false, "client can use SFTP and SSHFS")
+	rootCmd.Flags().BoolVarP(&flag.allowStreamlocalForward, "allow-streamlocal-forward", "", false, "client can use Unix domain socket remote forwarding (ssh -R)")
+	rootCmd.Flags().BoolVarP(&flag.allowDirectStreamlocal, "allow-direct-streamlocal", "", false, "client can use Unix domain socket local forwarding (ssh -L)")
 
+	rootCmd.CompletionOptions.DisableDefaultCmd = true
+	rootCmd.AddCommand(keygenCmd())
+	rootCmd.AddCommand(hashPasswordCmd())
+	rootCmd.AddCommand(sftpServerCmd())
 	return &rootCmd
 }
 
@@ -99,6 +254,11 @@ func rootRunEWithExtra(cmd *cobra.Command, args []string, flag *flagType, allPer
 		return nil
 	}
 	logger := slog.Default()
+	if flag.configFile != "" {
+		if err := applyConfigFile(cmd.Flags(), flag.configFile); err != nil {
+			return err
+		}
+	}
 
 	// Allow all permissions if all permission is not set
 	{
@@ -121,49 +281,270 @@ func rootRunEWithExtra(cmd *cobra.Command, args []string, flag *flagType, allPer
 		AllowSftp:               flag.allowSftp,
 		AllowStreamlocalForward: flag.allowStreamlocalForward,
 		AllowDirectStreamlocal:  flag.allowDirectStreamlocal,
+		MotdFile:                flag.motdFile,
+		CloseGracePeriod:        flag.closeGracePeriod,
+	}
+	for _, hostKeyType := range flag.hostKeyTypes {
+		if !slices.Contains(handy_sshd.KeyTypes, hostKeyType) {
+			return fmt.Errorf("unsupported host key type: %s", hostKeyType)
+		}
+	}
+	sourceAddresses, err := newSourceAddressFilter(flag.allowFrom, flag.denyFrom)
+	if err != nil {
+		return err
+	}
+	trustedProxies, err := parseIPNets(flag.proxyProtocolFrom)
+	if err != nil {
+		return fmt.Errorf("invalid --proxy-protocol-from: %w", err)
+	}
+	proxies := &sourceAddressFilter{allowed: trustedProxies}
+	var globalAuthorizedKeysSources []authorizedKeysSource
+	for _, path := range flag.authorizedKeysFiles {
+		globalAuthorizedKeysSources = append(globalAuthorizedKeysSources, &authorizedKeysFile{path: path})
 	}
+	var trustedUserCAKeysSources []authorizedKeysSource
+	for _, path := range flag.trustedUserCAKeysFiles {
+		trustedUserCAKeysSources = append(trustedUserCAKeysSources, &authorizedKeysFile{path: path})
+	}
+	authorizedKeysSources := append(append([]authorizedKeysSource{}, globalAuthorizedKeysSources...), trustedUserCAKeysSources...)
 	var sshUsers []sshUser
 	for _, u := range flag.sshUsers {
 		splits := strings.SplitN(u, ":", 2)
 		if len(splits) != 2 {
 			return fmt.Errorf("invalid user format: %s", u)
 		}
+		if strings.HasPrefix(splits[1], "@") {
+			location := strings.TrimPrefix(splits[1], "@")
+			// Fetched on demand not to fail on start when the URL is temporarily unavailable
+			if isAuthorizedKeysURL(location) {
+				source := &authorizedKeysURL{url: location, client: &http.Client{Timeout: authorizedKeysURLTimeout}, ttl: flag.authorizedKeysURLTTL, logger: logger}
+				sshUsers = append(sshUsers, sshUser{name: splits[0], authorizedKeysSources: []authorizedKeysSource{source}})
+				continue
+			}
+			source := &authorizedKeysFile{path: location}
+			sshUsers = append(sshUsers, sshUser{name: splits[0], authorizedKeysSources: []authorizedKeysSource{source}})
+			authorizedKeysSources = append(authorizedKeysSources, source)
+			continue
+		}
+		// Plain passwords starting with "$" are not taken for hashes
+		if hash, ok := strings.CutPrefix(splits[1], passwordHashMarker); ok {
+			if err := handy_sshd.ValidatePasswordHash(hash); err != nil {
+				return fmt.Errorf("invalid password hash of user %q: %w", splits[0], err)
+			}
+			sshUsers = append(sshUsers, sshUser{name: splits[0], password: hash, passwordHashed: true})
+			continue
+		}
 		sshUsers = append(sshUsers, sshUser{name: splits[0], password: splits[1]})
 	}
-	if len(sshUsers) == 0 {
+	for _, userFrom := range flag.userFrom {
+		name, patterns, ok := strings.Cut(userFrom, ":")
+		if !ok {
+			return fmt.Errorf("invalid --user-from format: %s", userFrom)
+		}
+		for _, pattern := range strings.Split(patterns, ",") {
+			if err := validateFromPattern(pattern); err != nil {
+				return fmt.Errorf("invalid --user-from of user %q: %w", name, err)
+			}
+		}
+		found := false
+		for i := range sshUsers {
+			if sshUsers[i].name == name {
+				sshUsers[i].from = patterns
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("--user-from of user %q not in --user", name)
+		}
+	}
+	users := &userStore{flagUsers: sshUsers, usersFile: flag.usersFile, logger: logger}
+	if flag.systemUsers {
+		users.systemUsers = &systemUserSource{passwdPath: passwdPath, shadowPath: shadowPath}
+		if _, err := users.systemUsers.users(); err != nil {
+			return fmt.Errorf("failed to load system users: %w", err)
+		}
+		if _, err := os.ReadFile(shadowPath); err != nil {
+			logger.Warn("passwords of system users are not available (public keys only)", "err", err)
+		}
+	}
+	if flag.usersFile != "" {
+		if err := users.load(); err != nil {
+			return err
+		}
+		stopWatching := make(chan struct{})
+		defer close(stopWatching)
+		users.watch(stopWatching)
+	}
+	// Users are principals of certificates when trusted CA keys are specified
+	if len(sshUsers) == 0 && len(trustedUserCAKeysSources) == 0 && flag.usersFile == "" && !flag.systemUsers && flag.authCommand == "" && flag.authUrl == "" {
 		return fmt.Errorf(`No user specified
 e.g. --user "john:mypass"
 e.g. --user "john:"`)
 	}
-	// (base: https://gist.github.com/jpillora/b480fde82bff51a06238)
-	sshConfig := &ssh.ServerConfig{
-		//Define a function to run when a client attempts a password login
-		PasswordCallback: func(metadata ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			for _, user := range sshUsers {
-				// No auth required
-				if user.name == metadata.User() && user.password == string(pass) {
-					return nil, nil
+	// Fail fast on unreadable authorized_keys
+	for _, source := range authorizedKeysSources {
+		if _, err := source.authorizedKeys(); err != nil {
+			return fmt.Errorf("failed to load authorized keys: %w", err)
+		}
+	}
+	certChecker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, source := range trustedUserCAKeysSources {
+				keys, err := source.authorizedKeys()
+				if err != nil {
+					logger.Error("failed to load trusted user CA keys", "source", source.String(), "err", err)
+					continue
 				}
-			}
-			return nil, fmt.Errorf("password rejected for %q", metadata.User())
-		},
-		NoClientAuth: true,
-		NoClientAuthCallback: func(metadata ssh.ConnMetadata) (*ssh.Permissions, error) {
-			for _, user := range sshUsers {
-				// No auth required
-				if user.name == metadata.User() && user.password == "" {
-					return nil, nil
+				for _, key := range keys {
+					if key.matches(auth) {
+						return true
+					}
 				}
 			}
-			return nil, fmt.Errorf("%s auth required", metadata.User())
+			return false
 		},
+		SupportedCriticalOptions: []string{handy_sshd.CriticalOptionForceCommand, handy_sshd.CriticalOptionSourceAddress},
 	}
-	// TODO: specify priv_key by flags
-	pri, err := ssh.ParsePrivateKey([]byte(defaultHostKeyPem))
-	if err != nil {
-		return err
+	auth := &authenticator{
+		logger:                      logger,
+		users:                       users,
+		globalAuthorizedKeysSources: globalAuthorizedKeysSources,
+		certChecker:                 certChecker,
+		totp:                        newTotpVerifier(),
+	}
+	if flag.authCommand != "" {
+		auth.hooks = append(auth.hooks, &authCommand{command: flag.authCommand})
+	}
+	if flag.authUrl != "" {
+		auth.hooks = append(auth.hooks, &authURL{url: flag.authUrl, client: &http.Client{Timeout: authHookTimeout}})
+	}
+	// (base: https://gist.github.com/jpillora/b480fde82bff51a06238)
+	sshConfig := &ssh.ServerConfig{
+		PasswordCallback:  auth.passwordCallback(&authState{}),
+		PublicKeyCallback: auth.publicKeyCallback(&authState{}),
+		// For clients which only speak keyboard-interactive and the TOTP code
+		KeyboardInteractiveCallback: auth.keyboardInteractiveCallback(&authState{}),
+		NoClientAuth:                true,
+		NoClientAuthCallback:        auth.noClientAuthCallback,
+		MaxAuthTries:                flag.maxAuthTries,
+	}
+	if flag.bannerFile != "" {
+		sshConfig.BannerCallback, err = loadBanner(logger, flag.bannerFile)
+		if err != nil {
+			return err
+		}
+	}
+	if flag.authFailuresLimit > 0 {
+		auth.failures = newAuthFailures(logger, flag.authFailuresLimit, flag.authFailuresWindow, flag.authBanDuration)
+		sshConfig.AuthLogCallback = auth.failures.authLogCallback
+	}
+	var hostKeyAlgorithms []string
+	if flag.algorithmsPreset != "" {
+		preset, ok := algorithmsPresets[flag.algorithmsPreset]
+		if !ok {
+			return fmt.Errorf("unknown algorithms preset: %s (%s)", flag.algorithmsPreset, strings.Join(algorithmsPresetNames(), ", "))
+		}
+		sshConfig.KeyExchanges, sshConfig.Ciphers, sshConfig.MACs, hostKeyAlgorithms = preset.kexAlgorithms, preset.ciphers, preset.macs, preset.hostKeyAlgorithms
+	}
+	// Flags take precedence over the preset
+	for _, algorithms := range []struct {
+		flagName  string
+		values    []string
+		supported []string
+		target    *[]string
+	}{
+		{flagName: "--kex-algorithms", values: flag.kexAlgorithms, supported: supportedKexAlgorithms, target: &sshConfig.KeyExchanges},
+		{flagName: "--ciphers", values: flag.ciphers, supported: supportedCiphers, target: &sshConfig.Ciphers},
+		{flagName: "--macs", values: flag.macs, supported: supportedMACs, target: &sshConfig.MACs},
+		{flagName: "--host-key-algorithms", values: flag.hostKeyAlgorithms, supported: supportedHostKeyAlgorithms, target: &hostKeyAlgorithms},
+	} {
+		if len(algorithms.values) == 0 {
+			continue
+		}
+		if err := validateAlgorithms(algorithms.flagName, algorithms.values, algorithms.supported); err != nil {
+			return err
+		}
+		*algorithms.target = algorithms.values
+	}
+	// Fill the defaults of golang.org/x/crypto/ssh to log negotiated algorithms
+	sshConfig.SetDefaults()
+	offeredAlgorithms := &serverAlgorithms{kexAlgorithms: sshConfig.KeyExchanges, ciphers: sshConfig.Ciphers, macs: sshConfig.MACs}
+	var hostKeys []ssh.Signer
+	if len(flag.hostKeyFiles) != 0 {
+		passphrase := keyPassphrase(flag.hostKeyPassphraseEnv, flag.hostKeyPassphraseFile, "--host-key-passphrase")
+		for _, hostKeyFile := range flag.hostKeyFiles {
+			hostKey, err := loadPrivateKeyFile(hostKeyFile, passphrase)
+			if err != nil {
+				return err
+			}
+			hostKeys = append(hostKeys, hostKey)
+		}
+		if flag.hostKeyPassphraseEnv != "" {
+			// Not to pass the passphrase to sessions
+			os.Unsetenv(flag.hostKeyPassphraseEnv)
+		}
+	} else {
+		hostKeys, err = loadOrGenerateHostKeys(logger, flag.stateDir, flag.hostKeyTypes)
+		if err != nil {
+			logger.Warn("using the built-in host key shared by all handy-sshd binaries", "err", err)
+			pri, err := ssh.ParsePrivateKey([]byte(defaultHostKeyPem))
+			if err != nil {
+				return err
+			}
+			hostKeys = []ssh.Signer{pri}
+		}
+	}
+	// The first key of each type is used for key exchange. The rest are only announced to clients with "UpdateHostKeys yes" to rotate keys.
+	usedHostKeyTypes := map[string]struct{}{}
+	for _, hostKey := range hostKeys {
+		keyType := hostKey.PublicKey().Type()
+		if _, ok := usedHostKeyTypes[keyType]; ok {
+			logger.Info("host key (announced only)", "type", keyType, "fingerprint", ssh.FingerprintSHA256(hostKey.PublicKey()))
+			continue
+		}
+		signer, algorithms, err := newHostKeySigner(hostKey, nil, hostKeyAlgorithms)
+		if err != nil {
+			return err
+		}
+		if signer == nil {
+			logger.Info("host key not used by --host-key-algorithms", "type", keyType, "fingerprint", ssh.FingerprintSHA256(hostKey.PublicKey()))
+			continue
+		}
+		usedHostKeyTypes[keyType] = struct{}{}
+		sshConfig.AddHostKey(signer)
+		offeredAlgorithms.hostKeyAlgorithms = append(offeredAlgorithms.hostKeyAlgorithms, algorithms...)
+		logger.Info("host key", "type", keyType, "fingerprint", ssh.FingerprintSHA256(hostKey.PublicKey()))
+	}
+	sshServer.HostKeys = hostKeys
+	if executable, err := sftpHelperExecutable(); err == nil {
+		sshServer.SftpHelperCommand = []string{executable, "sftp-server"}
+	} else {
+		logger.Warn("SFTP not available for users running as another OS user", "err", err)
+	}
+	for _, hostCertificateFile := range flag.hostCertificateFiles {
+		hostKey, cert, err := loadHostCertificate(hostCertificateFile, hostKeys)
+		if err != nil {
+			return err
+		}
+		certSigner, algorithms, err := newHostKeySigner(hostKey, cert, hostKeyAlgorithms)
+		if err != nil {
+			return err
+		}
+		if certSigner == nil {
+			logger.Info("host certificate not used by --host-key-algorithms", "type", cert.Type(), "key_id", cert.KeyId)
+			continue
+		}
+		sshConfig.AddHostKey(certSigner)
+		offeredAlgorithms.hostKeyAlgorithms = append(offeredAlgorithms.hostKeyAlgorithms, algorithms...)
+		logger.Info("host certificate", "type", cert.Type(), "key_id", cert.KeyId, "principals", cert.ValidPrincipals, "fingerprint", ssh.FingerprintSHA256(cert.Key))
+		if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().Unix() >= int64(cert.ValidBefore) {
+			logger.Warn("host certificate expired", "path", hostCertificateFile)
+		}
+	}
+
+	if len(offeredAlgorithms.hostKeyAlgorithms) == 0 {
+		return fmt.Errorf("no host key usable with the host key algorithms: %s", strings.Join(hostKeyAlgorithms, ", "))
 	}
-	sshConfig.AddHostKey(pri)
 
 	var ln net.Listener
 	if flag.sshUnixSocket == "" {
@@ -190,15 +571,55 @@ e.g. --user "john:"`)
 			logger.Error("failed to accept TCP connection", "err", err)
 			continue
 		}
-		sshConn, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
-		if err != nil {
-			logger.Info("failed to handshake", "err", err)
-			conn.Close()
-			continue
-		}
-		logger.Info("new SSH connection", "remote_address", sshConn.RemoteAddr(), "client_version", string(sshConn.ClientVersion()))
-		go sshServer.HandleGlobalRequests(sshConn, reqs)
-		go sshServer.HandleChannels(flag.sshShell, chans)
+		// Handshake in another goroutine not to block other connections while delaying failed authentications or reading PROXY protocol headers
+		go func() {
+			if flag.proxyProtocol {
+				if !proxies.allows(conn.RemoteAddr()) {
+					logger.Info("connection refused by --proxy-protocol-from", "proxy_address", conn.RemoteAddr())
+					conn.Close()
+					return
+				}
+				proxiedConn, err := readProxyProtocolHeader(conn)
+				if err != nil {
+					logger.Info("failed to read PROXY protocol header", "proxy_address", conn.RemoteAddr(), "err", err)
+					conn.Close()
+					return
+				}
+				conn = proxiedConn
+			}
+			if !sourceAddresses.allows(conn.RemoteAddr()) {
+				logger.Info("connection refused by --allow-from and --deny-from", "remote_address", conn.RemoteAddr())
+				conn.Close()
+				return
+			}
+			if auth.failures != nil && auth.failures.remoteIPBanned(conn.RemoteAddr()) {
+				logger.Info("connection from banned IP refused", "remote_address", conn.RemoteAddr())
+				conn.Close()
+				return
+			}
+			recorderConn := &kexInitRecorderConn{Conn: conn}
+			sshConn, chans, reqs, err := ssh.NewServerConn(recorderConn, sshConfig)
+			if err != nil {
+				logger.Info("failed to handshake", "err", err)
+				conn.Close()
+				return
+			}
+			logger.Info("new SSH connection", "remote_address", sshConn.RemoteAddr(), "client_version", string(sshConn.ClientVersion()))
+			if clientKexInit := recorderConn.clientKexInit(); clientKexInit != nil {
+				negotiated := offeredAlgorithms.negotiate(clientKexInit)
+				logger.Info("negotiated algorithms", "remote_address", sshConn.RemoteAddr(), "kex", negotiated.kex, "host_key", negotiated.hostKey, "cipher", negotiated.cipher, "mac", negotiated.mac)
+				// For proofs of RSA host keys
+				if sshConn.Permissions == nil {
+					sshConn.Permissions = &ssh.Permissions{}
+				}
+				if sshConn.Permissions.Extensions == nil {
+					sshConn.Permissions.Extensions = map[string]string{}
+				}
+				sshConn.Permissions.Extensions[handy_sshd.ExtensionHostKeyAlgorithm] = negotiated.hostKey
+			}
+			go sshServer.HandleGlobalRequests(sshConn, reqs)
+			go sshServer.HandleChannels(sshConn, flag.sshShell, chans)
+		}()
 	}
 }
 
@@ -3,14 +3,45 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"github.com/nwtgck/handy-sshd/version"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/ssh"
 	"net"
+	"os"
+	"path"
 	"strconv"
 	"testing"
+	"time"
 )
 
+func TestMain(m *testing.M) {
+	// The test binary serves as the SFTP helper process (see sftpHelperExecutable)
+	if len(os.Args) > 1 && os.Args[1] == "sftp-server" {
+		rootCmd := RootCmd()
+		rootCmd.SetArgs(os.Args[1:])
+		if err := rootCmd.Execute(); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	// Not to store generated host keys in the real state directory
+	stateHome, err := os.MkdirTemp("", "handy-sshd-test-state-")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XDG_STATE_HOME", stateHome)
+	code := m.Run()
+	os.RemoveAll(stateHome)
+	os.Exit(code)
+}
+
 func TestVersion(t *testing.T) {
 	rootCmd := RootCmd()
 	rootCmd.SetArgs([]string{"--version"})
@@ -325,3 +356,616 @@ func TestAllowSftp(t *testing.T) {
 	assertNoUnixRemotePortForwarding(t, client)
 	assertSftp(t, client)
 }
+
+func TestPublicKeyAuthentication(t *testing.T) {
+	var signers []ssh.Signer
+	for _, privateKey := range []crypto.Signer{generateEd25519Key(t), generateEcdsaKey(t), generateRsaKey(t)} {
+		signer, err := ssh.NewSignerFromSigner(privateKey)
+		assert.NoError(t, err)
+		signers = append(signers, signer)
+	}
+	authorizedKeysPath := writeAuthorizedKeys(t, signers...)
+	rootCmd := RootCmd()
+	port := getAvailableTcpPort()
+	rootCmd.SetArgs([]string{"--port", strconv.Itoa(port), "--user", "john:@" + authorizedKeysPath})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		var stderrBuf bytes.Buffer
+		rootCmd.SetErr(&stderrBuf)
+		rootCmd.ExecuteContext(ctx)
+	}()
+	waitTCPServer(port)
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	for _, signer := range signers {
+		sshClientConfig := &ssh.ClientConfig{
+			User:            "john",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		}
+		client, err := ssh.Dial("tcp", address, sshClientConfig)
+		assert.NoError(t, err)
+		defer client.Close()
+	}
+	// Unknown key
+	{
+		signer, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+		assert.NoError(t, err)
+		sshClientConfig := &ssh.ClientConfig{
+			User:            "john",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		}
+		_, err = ssh.Dial("tcp", address, sshClientConfig)
+		assert.Error(t, err)
+	}
+	// No password authentication for the user only with authorized keys
+	{
+		sshClientConfig := &ssh.ClientConfig{
+			User:            "john",
+			Auth:            []ssh.AuthMethod{ssh.Password("")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		}
+		_, err := ssh.Dial("tcp", address, sshClientConfig)
+		assert.Error(t, err)
+	}
+}
+
+func TestGlobalAuthorizedKeysWithPassword(t *testing.T) {
+	signer, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	authorizedKeysPath := writeAuthorizedKeys(t, signer)
+	rootCmd := RootCmd()
+	port := getAvailableTcpPort()
+	rootCmd.SetArgs([]string{"--port", strconv.Itoa(port), "--user", "john:mypass", "--authorized-keys", authorizedKeysPath})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		var stderrBuf bytes.Buffer
+		rootCmd.SetErr(&stderrBuf)
+		rootCmd.ExecuteContext(ctx)
+	}()
+	waitTCPServer(port)
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	for _, authMethod := range []ssh.AuthMethod{ssh.PublicKeys(signer), ssh.Password("mypass")} {
+		sshClientConfig := &ssh.ClientConfig{
+			User:            "john",
+			Auth:            []ssh.AuthMethod{authMethod},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		}
+		client, err := ssh.Dial("tcp", address, sshClientConfig)
+		assert.NoError(t, err)
+		defer client.Close()
+	}
+}
+
+func TestMissingAuthorizedKeys(t *testing.T) {
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{"--user", "john:@" + path.Join(t.TempDir(), "no_such_authorized_keys")})
+	var stderrBuf bytes.Buffer
+	rootCmd.SetErr(&stderrBuf)
+	assert.Error(t, rootCmd.Execute())
+}
+
+func TestAuthorizedKeyOptions(t *testing.T) {
+	newSigner := func() ssh.Signer {
+		signer, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+		assert.NoError(t, err)
+		return signer
+	}
+	restrictedSigner := newSigner()
+	commandSigner := newSigner()
+	environmentSigner := newSigner()
+	permitOpenSigner := newSigner()
+	fromSigner := newSigner()
+	expiredSigner := newSigner()
+	authorizedKeys := authorizedKeyLine("restrict", restrictedSigner) +
+		authorizedKeyLine(`command="echo forced"`, commandSigner) +
+		authorizedKeyLine(`environment="HANDY_SSHD_TEST=hello"`, environmentSigner) +
+		authorizedKeyLine(`permitopen="127.0.0.1:1"`, permitOpenSigner) +
+		authorizedKeyLine(`from="10.0.0.0/8,!127.0.0.1"`, fromSigner) +
+		authorizedKeyLine(`expiry-time="20000101"`, expiredSigner)
+	authorizedKeysPath := path.Join(t.TempDir(), "authorized_keys")
+	assert.NoError(t, os.WriteFile(authorizedKeysPath, []byte(authorizedKeys), 0600))
+	rootCmd := RootCmd()
+	port := getAvailableTcpPort()
+	rootCmd.SetArgs([]string{"--port", strconv.Itoa(port), "--user", "john:@" + authorizedKeysPath})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		var stderrBuf bytes.Buffer
+		rootCmd.SetErr(&stderrBuf)
+		rootCmd.ExecuteContext(ctx)
+	}()
+	waitTCPServer(port)
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	dial := func(signer ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", address, &ssh.ClientConfig{
+			User:            "john",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+
+	{
+		client, err := dial(restrictedSigner)
+		assert.NoError(t, err)
+		defer client.Close()
+		assertExec(t, client)
+		assertNoPtyTerminal(t, client)
+		assertNoLocalPortForwarding(t, client)
+		assertNoRemotePortForwarding(t, client)
+		assertNoUnixLocalPortForwarding(t, client)
+		assertNoUnixRemotePortForwarding(t, client)
+	}
+	{
+		client, err := dial(commandSigner)
+		assert.NoError(t, err)
+		defer client.Close()
+		session, err := client.NewSession()
+		assert.NoError(t, err)
+		defer session.Close()
+		output, err := session.Output("whoami")
+		assert.NoError(t, err)
+		assert.Equal(t, "forced\n", string(output))
+		assertNoSftp(t, client)
+	}
+	{
+		client, err := dial(environmentSigner)
+		assert.NoError(t, err)
+		defer client.Close()
+		session, err := client.NewSession()
+		assert.NoError(t, err)
+		defer session.Close()
+		output, err := session.Output(`sh -c 'echo $HANDY_SSHD_TEST'`)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\n", string(output))
+	}
+	{
+		client, err := dial(permitOpenSigner)
+		assert.NoError(t, err)
+		defer client.Close()
+		_, err = client.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234})
+		assert.Error(t, err)
+		assert.Equal(t, "ssh: rejected: administratively prohibited (direct-tcpip to the address not permitted)", err.Error())
+	}
+	for _, signer := range []ssh.Signer{fromSigner, expiredSigner} {
+		_, err := dial(signer)
+		assert.Error(t, err)
+	}
+}
+
+func TestUserCertificate(t *testing.T) {
+	caSigner, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	trustedUserCAKeysPath := writeAuthorizedKeys(t, caSigner)
+	rootCmd := RootCmd()
+	port := getAvailableTcpPort()
+	rootCmd.SetArgs([]string{"--port", strconv.Itoa(port), "--trusted-user-ca-keys", trustedUserCAKeysPath})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		var stderrBuf bytes.Buffer
+		rootCmd.SetErr(&stderrBuf)
+		rootCmd.ExecuteContext(ctx)
+	}()
+	waitTCPServer(port)
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	now := time.Now()
+	dial := func(caSigner ssh.Signer, cert *ssh.Certificate) (*ssh.Client, error) {
+		signer, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+		assert.NoError(t, err)
+		cert.Key = signer.PublicKey()
+		cert.CertType = ssh.UserCert
+		assert.NoError(t, cert.SignCert(rand.Reader, caSigner))
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		assert.NoError(t, err)
+		return ssh.Dial("tcp", address, &ssh.ClientConfig{
+			User:            "john",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(certSigner)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+	allExtensions := map[string]string{"permit-pty": "", "permit-port-forwarding": ""}
+
+	{
+		client, err := dial(caSigner, &ssh.Certificate{
+			ValidPrincipals: []string{"john"},
+			ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+			Permissions:     ssh.Permissions{Extensions: allExtensions},
+		})
+		assert.NoError(t, err)
+		defer client.Close()
+		assertExec(t, client)
+		assertPtyTerminal(t, client)
+		assertLocalPortForwarding(t, client)
+	}
+	{
+		client, err := dial(caSigner, &ssh.Certificate{
+			ValidPrincipals: []string{"john"},
+			ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+		})
+		assert.NoError(t, err)
+		defer client.Close()
+		assertNoPtyTerminal(t, client)
+		assertNoLocalPortForwarding(t, client)
+	}
+	{
+		client, err := dial(caSigner, &ssh.Certificate{
+			ValidPrincipals: []string{"john"},
+			ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+			Permissions: ssh.Permissions{
+				CriticalOptions: map[string]string{"force-command": "echo forced"},
+				Extensions:      allExtensions,
+			},
+		})
+		assert.NoError(t, err)
+		defer client.Close()
+		session, err := client.NewSession()
+		assert.NoError(t, err)
+		defer session.Close()
+		output, err := session.Output("whoami")
+		assert.NoError(t, err)
+		assert.Equal(t, "forced\n", string(output))
+	}
+	untrustedCASigner, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	for _, c := range []struct {
+		caSigner ssh.Signer
+		cert     *ssh.Certificate
+	}{
+		// Wrong principal
+		{caSigner: caSigner, cert: &ssh.Certificate{ValidPrincipals: []string{"alex"}, ValidBefore: ssh.CertTimeInfinity}},
+		// No principals
+		{caSigner: caSigner, cert: &ssh.Certificate{ValidBefore: ssh.CertTimeInfinity}},
+		// Expired
+		{caSigner: caSigner, cert: &ssh.Certificate{ValidPrincipals: []string{"john"}, ValidBefore: uint64(now.Add(-time.Minute).Unix())}},
+		// Not allowed source address
+		{caSigner: caSigner, cert: &ssh.Certificate{ValidPrincipals: []string{"john"}, ValidBefore: ssh.CertTimeInfinity, Permissions: ssh.Permissions{CriticalOptions: map[string]string{"source-address": "10.0.0.0/8"}}}},
+		// Untrusted CA
+		{caSigner: untrustedCASigner, cert: &ssh.Certificate{ValidPrincipals: []string{"john"}, ValidBefore: ssh.CertTimeInfinity}},
+	} {
+		_, err := dial(c.caSigner, c.cert)
+		assert.Error(t, err)
+	}
+}
+
+func TestPersistentHostKey(t *testing.T) {
+	stateDir := t.TempDir()
+	getHostKey := func() ssh.PublicKey {
+		rootCmd := RootCmd()
+		port := getAvailableTcpPort()
+		rootCmd.SetArgs([]string{"--port", strconv.Itoa(port), "--user", "john:", "--state-dir", stateDir, "--host-key-types", "ed25519,ecdsa"})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			var stderrBuf bytes.Buffer
+			rootCmd.SetErr(&stderrBuf)
+			rootCmd.ExecuteContext(ctx)
+		}()
+		waitTCPServer(port)
+		var hostKey ssh.PublicKey
+		sshClientConfig := &ssh.ClientConfig{
+			User:              "john",
+			HostKeyAlgorithms: []string{ssh.KeyAlgoED25519},
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				hostKey = key
+				return nil
+			},
+		}
+		client, err := ssh.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), sshClientConfig)
+		assert.NoError(t, err)
+		client.Close()
+		return hostKey
+	}
+	hostKey1 := getHostKey()
+	assert.FileExists(t, path.Join(stateDir, "ssh_host_ed25519_key"))
+	assert.FileExists(t, path.Join(stateDir, "ssh_host_ed25519_key.pub"))
+	assert.FileExists(t, path.Join(stateDir, "ssh_host_ecdsa_key"))
+	hostKey2 := getHostKey()
+	assert.Equal(t, hostKey1.Marshal(), hostKey2.Marshal())
+	// Not the key shared by all handy-sshd binaries
+	defaultHostKey, err := ssh.ParsePrivateKey([]byte(defaultHostKeyPem))
+	assert.NoError(t, err)
+	assert.NotEqual(t, defaultHostKey.PublicKey().Marshal(), hostKey1.Marshal())
+}
+
+func TestHostKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	writePem := func(name string, block *pem.Block) string {
+		keyPath := path.Join(dir, name)
+		assert.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600))
+		return keyPath
+	}
+	rsaKey := generateRsaKey(t).(*rsa.PrivateKey)
+	ed25519Key := generateEd25519Key(t)
+	pkcs8Bytes, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	assert.NoError(t, err)
+	ecdsaP384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	sec1Bytes, err := x509.MarshalECPrivateKey(ecdsaP384Key)
+	assert.NoError(t, err)
+	ecdsaP256Key := generateEcdsaKey(t)
+	encryptedBlock, err := ssh.MarshalPrivateKeyWithPassphrase(ecdsaP256Key, "", []byte("mypassphrase"))
+	assert.NoError(t, err)
+	t.Setenv("HANDY_SSHD_TEST_PASSPHRASE", "mypassphrase")
+
+	rootCmd := RootCmd()
+	port := getAvailableTcpPort()
+	rootCmd.SetArgs([]string{
+		"--port", strconv.Itoa(port), "--user", "john:",
+		"--host-key", writePem("pkcs1", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+		"--host-key", writePem("pkcs8", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Bytes}),
+		"--host-key", writePem("sec1", &pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1Bytes}),
+		"--host-key", writePem("openssh", encryptedBlock),
+		"--host-key-passphrase-env", "HANDY_SSHD_TEST_PASSPHRASE",
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		var stderrBuf bytes.Buffer
+		rootCmd.SetErr(&stderrBuf)
+		rootCmd.ExecuteContext(ctx)
+	}()
+	waitTCPServer(port)
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	for _, c := range []struct {
+		hostKeyAlgorithm string
+		privateKey       crypto.Signer
+	}{
+		{hostKeyAlgorithm: ssh.KeyAlgoRSASHA256, privateKey: rsaKey},
+		{hostKeyAlgorithm: ssh.KeyAlgoED25519, privateKey: ed25519Key},
+		{hostKeyAlgorithm: ssh.KeyAlgoECDSA384, privateKey: ecdsaP384Key},
+		{hostKeyAlgorithm: ssh.KeyAlgoECDSA256, privateKey: ecdsaP256Key},
+	} {
+		expectedHostKey, err := ssh.NewPublicKey(c.privateKey.Public())
+		assert.NoError(t, err)
+		sshClientConfig := &ssh.ClientConfig{
+			User:              "john",
+			HostKeyAlgorithms: []string{c.hostKeyAlgorithm},
+			HostKeyCallback:   ssh.FixedHostKey(expectedHostKey),
+		}
+		client, err := ssh.Dial("tcp", address, sshClientConfig)
+		assert.NoError(t, err)
+		client.Close()
+	}
+
+	// The passphrase is not passed to sessions
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{User: "john", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	assert.NoError(t, err)
+	defer client.Close()
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	output, err := session.Output("env")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(output), "HANDY_SSHD_TEST_PASSPHRASE")
+}
+
+func TestEncryptedHostKeyWithoutPassphrase(t *testing.T) {
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(generateEd25519Key(t), "", []byte("mypassphrase"))
+	assert.NoError(t, err)
+	keyPath := path.Join(t.TempDir(), "host_key")
+	assert.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600))
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{"--user", "john:", "--host-key", keyPath})
+	var stderrBuf bytes.Buffer
+	rootCmd.SetErr(&stderrBuf)
+	assert.Error(t, rootCmd.Execute())
+}
+
+func TestHostKeyRotationProofWithNegotiatedRSAAlgorithm(t *testing.T) {
+	rsaKey := generateRsaKey(t).(*rsa.PrivateKey)
+	keyPath := path.Join(t.TempDir(), "rsa_key")
+	assert.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), 0600))
+	rsaPublicKey, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+	address := startServer(t, "--user", "john:", "--host-key", keyPath)
+	conn, err := net.Dial("tcp", address)
+	assert.NoError(t, err)
+	sshConn, _, _, err := ssh.NewClientConn(conn, address, &ssh.ClientConfig{
+		User:              "john",
+		HostKeyAlgorithms: []string{ssh.KeyAlgoRSASHA256},
+		HostKeyCallback:   ssh.FixedHostKey(rsaPublicKey),
+	})
+	assert.NoError(t, err)
+	defer sshConn.Close()
+
+	ok, response, err := sshConn.SendRequest("hostkeys-prove-00@openssh.com", true, ssh.Marshal(struct{ Key []byte }{rsaPublicKey.Marshal()}))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	var msg struct{ Signature []byte }
+	assert.NoError(t, ssh.Unmarshal(response, &msg))
+	var signature ssh.Signature
+	assert.NoError(t, ssh.Unmarshal(msg.Signature, &signature))
+	assert.Equal(t, ssh.KeyAlgoRSASHA256, signature.Format)
+	signedData := ssh.Marshal(struct{ RequestType, SessionID, HostKey []byte }{[]byte("hostkeys-prove-00@openssh.com"), sshConn.SessionID(), rsaPublicKey.Marshal()})
+	assert.NoError(t, rsaPublicKey.Verify(signedData, &signature))
+}
+
+func TestHostCertificate(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"host_ca", "ssh_host_ed25519_key"} {
+		rootCmd := RootCmd()
+		rootCmd.SetArgs([]string{"keygen", "-f", path.Join(dir, name)})
+		rootCmd.SetOut(&bytes.Buffer{})
+		assert.NoError(t, rootCmd.Execute())
+	}
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{"keygen", "sign-host", "--ca", path.Join(dir, "host_ca"), "-n", "127.0.0.1", "-V", "1d", path.Join(dir, "ssh_host_ed25519_key.pub")})
+	rootCmd.SetOut(&bytes.Buffer{})
+	assert.NoError(t, rootCmd.Execute())
+	caPublicKeyBytes, err := os.ReadFile(path.Join(dir, "host_ca.pub"))
+	assert.NoError(t, err)
+	caPublicKey, _, _, _, err := ssh.ParseAuthorizedKey(caPublicKeyBytes)
+	assert.NoError(t, err)
+
+	rootCmd = RootCmd()
+	port := getAvailableTcpPort()
+	rootCmd.SetArgs([]string{
+		"--port", strconv.Itoa(port), "--user", "john:",
+		"--host-key", path.Join(dir, "ssh_host_ed25519_key"),
+		"--host-certificate", path.Join(dir, "ssh_host_ed25519_key-cert.pub"),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		var stderrBuf bytes.Buffer
+		rootCmd.SetErr(&stderrBuf)
+		rootCmd.ExecuteContext(ctx)
+	}()
+	waitTCPServer(port)
+	certChecker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return bytes.Equal(auth.Marshal(), caPublicKey.Marshal())
+		},
+	}
+	sshClientConfig := &ssh.ClientConfig{
+		User:              "john",
+		HostKeyAlgorithms: []string{ssh.CertAlgoED25519v01},
+		HostKeyCallback:   certChecker.CheckHostKey,
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), sshClientConfig)
+	assert.NoError(t, err)
+	client.Close()
+
+	// The plain host key is still available
+	hostPublicKeyBytes, err := os.ReadFile(path.Join(dir, "ssh_host_ed25519_key.pub"))
+	assert.NoError(t, err)
+	hostPublicKey, _, _, _, err := ssh.ParseAuthorizedKey(hostPublicKeyBytes)
+	assert.NoError(t, err)
+	sshClientConfig = &ssh.ClientConfig{
+		User:              "john",
+		HostKeyAlgorithms: []string{ssh.KeyAlgoED25519},
+		HostKeyCallback:   ssh.FixedHostKey(hostPublicKey),
+	}
+	client, err = ssh.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), sshClientConfig)
+	assert.NoError(t, err)
+	client.Close()
+}
+
+func TestHostCertificateWithoutHostKey(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"host_ca", "ssh_host_ed25519_key", "other_key"} {
+		rootCmd := RootCmd()
+		rootCmd.SetArgs([]string{"keygen", "-f", path.Join(dir, name)})
+		rootCmd.SetOut(&bytes.Buffer{})
+		assert.NoError(t, rootCmd.Execute())
+	}
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{"keygen", "sign-host", "--ca", path.Join(dir, "host_ca"), "-n", "127.0.0.1", path.Join(dir, "other_key.pub")})
+	rootCmd.SetOut(&bytes.Buffer{})
+	assert.NoError(t, rootCmd.Execute())
+
+	rootCmd = RootCmd()
+	rootCmd.SetArgs([]string{
+		"--user", "john:",
+		"--host-key", path.Join(dir, "ssh_host_ed25519_key"),
+		"--host-certificate", path.Join(dir, "other_key-cert.pub"),
+	})
+	var stderrBuf bytes.Buffer
+	rootCmd.SetErr(&stderrBuf)
+	assert.Error(t, rootCmd.Execute())
+	assert.Contains(t, stderrBuf.String(), "no host key for "+path.Join(dir, "other_key-cert.pub"))
+}
+
+func TestHostKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"old_key", "new_key"} {
+		rootCmd := RootCmd()
+		rootCmd.SetArgs([]string{"keygen", "-f", path.Join(dir, name)})
+		rootCmd.SetOut(&bytes.Buffer{})
+		assert.NoError(t, rootCmd.Execute())
+	}
+	rsaKey := generateRsaKey(t).(*rsa.PrivateKey)
+	assert.NoError(t, os.WriteFile(path.Join(dir, "rsa_key"), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), 0600))
+	var hostKeys []ssh.PublicKey
+	for _, name := range []string{"old_key", "new_key"} {
+		b, err := os.ReadFile(path.Join(dir, name+".pub"))
+		assert.NoError(t, err)
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey(b)
+		assert.NoError(t, err)
+		hostKeys = append(hostKeys, publicKey)
+	}
+	rsaPublicKey, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+	hostKeys = append(hostKeys, rsaPublicKey)
+
+	rootCmd := RootCmd()
+	port := getAvailableTcpPort()
+	rootCmd.SetArgs([]string{
+		"--port", strconv.Itoa(port), "--user", "john:",
+		"--host-key", path.Join(dir, "old_key"),
+		"--host-key", path.Join(dir, "new_key"),
+		"--host-key", path.Join(dir, "rsa_key"),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		var stderrBuf bytes.Buffer
+		rootCmd.SetErr(&stderrBuf)
+		rootCmd.ExecuteContext(ctx)
+	}()
+	waitTCPServer(port)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	assert.NoError(t, err)
+	sshClientConfig := &ssh.ClientConfig{
+		User:              "john",
+		HostKeyAlgorithms: []string{ssh.KeyAlgoED25519},
+		// The new key is only announced and the old key is used for key exchange
+		HostKeyCallback: ssh.FixedHostKey(hostKeys[0]),
+	}
+	sshConn, _, reqs, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), sshClientConfig)
+	assert.NoError(t, err)
+	defer sshConn.Close()
+
+	req := <-reqs
+	assert.Equal(t, "hostkeys-00@openssh.com", req.Type)
+	var announcedHostKeys []string
+	rest := req.Payload
+	for len(rest) > 0 {
+		var msg struct {
+			HostKey []byte
+			Rest    []byte `ssh:"rest"`
+		}
+		assert.NoError(t, ssh.Unmarshal(rest, &msg))
+		announcedHostKeys = append(announcedHostKeys, string(msg.HostKey))
+		rest = msg.Rest
+	}
+	var expectedHostKeys []string
+	for _, hostKey := range hostKeys {
+		expectedHostKeys = append(expectedHostKeys, string(hostKey.Marshal()))
+	}
+	assert.Equal(t, expectedHostKeys, announcedHostKeys)
+
+	ok, response, err := sshConn.SendRequest("hostkeys-prove-00@openssh.com", true, ssh.Marshal(struct{ NewKey, RsaKey []byte }{hostKeys[1].Marshal(), rsaPublicKey.Marshal()}))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	var signatures struct{ NewKey, RsaKey []byte }
+	assert.NoError(t, ssh.Unmarshal(response, &signatures))
+	for _, c := range []struct {
+		hostKey   ssh.PublicKey
+		signature []byte
+	}{{hostKeys[1], signatures.NewKey}, {rsaPublicKey, signatures.RsaKey}} {
+		var signature ssh.Signature
+		assert.NoError(t, ssh.Unmarshal(c.signature, &signature))
+		signedData := ssh.Marshal(struct{ RequestType, SessionID, HostKey []byte }{[]byte("hostkeys-prove-00@openssh.com"), sshConn.SessionID(), c.hostKey.Marshal()})
+		assert.NoError(t, c.hostKey.Verify(signedData, &signature))
+	}
+	// rsa-sha2-512 is used when the RSA key is not used in the key exchange
+	var rsaSignature ssh.Signature
+	assert.NoError(t, ssh.Unmarshal(signatures.RsaKey, &rsaSignature))
+	assert.Equal(t, ssh.KeyAlgoRSASHA512, rsaSignature.Format)
+
+	// A key which is not a host key
+	otherKey, err := ssh.NewPublicKey(generateEd25519Key(t).Public())
+	assert.NoError(t, err)
+	ok, _, err = sshConn.SendRequest("hostkeys-prove-00@openssh.com", true, ssh.Marshal(struct{ Key []byte }{otherKey.Marshal()}))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,101 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestRunAs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("root required")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("user nobody not found")
+	}
+	// Directory accessible by nobody
+	dir, err := os.MkdirTemp("", "handy-sshd-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.Chmod(dir, 0777))
+	// The test binary is copied because the build directory is not accessible by nobody
+	executable, err := os.Executable()
+	assert.NoError(t, err)
+	b, err := os.ReadFile(executable)
+	assert.NoError(t, err)
+	helperPath := path.Join(dir, "handy-sshd")
+	assert.NoError(t, os.WriteFile(helperPath, b, 0755))
+	oldSftpHelperExecutable := sftpHelperExecutable
+	sftpHelperExecutable = func() (string, error) {
+		return helperPath, nil
+	}
+	t.Cleanup(func() {
+		sftpHelperExecutable = oldSftpHelperExecutable
+	})
+
+	usersFilePath := path.Join(dir, "users.yaml")
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte(`
+users:
+  - name: john
+    password: mypass
+    run_as: nobody
+    environment: {FOO: bar}
+`), 0600))
+	// Not passed to sessions running as other users
+	t.Setenv("HANDY_SSHD_TEST_SECRET", "mysecret")
+	address := startUsersFileServer(t, usersFilePath, "--allow-execute", "--allow-sftp")
+	client, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	output, err := session.Output(`sh -c 'echo "$(id -u) $(id -g) $USER $LOGNAME $HOME"'`)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%s %s nobody nobody %s\n", nobody.Uid, nobody.Gid, nobody.HomeDir), string(output))
+	session, err = client.NewSession()
+	assert.NoError(t, err)
+	output, err = session.Output("env")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(output), "HANDY_SSHD_TEST_SECRET")
+	assert.Contains(t, string(output), "PATH=/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin\n")
+	assert.Contains(t, string(output), "FOO=bar\n")
+
+	sftpClient, err := sftp.NewClient(client)
+	assert.NoError(t, err)
+	defer sftpClient.Close()
+	f, err := sftpClient.Create(path.Join(dir, "uploaded.txt"))
+	assert.NoError(t, err)
+	_, err = io.WriteString(f, "hello")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	stat, err := os.Stat(path.Join(dir, "uploaded.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, nobody.Uid, strconv.Itoa(int(stat.Sys().(*syscall.Stat_t).Uid)))
+	// Files not accessible by nobody
+	_, err = sftpClient.Open(usersFilePath)
+	assert.Error(t, err)
+}
+
+func TestRunAsUnknownUser(t *testing.T) {
+	usersFilePath := path.Join(t.TempDir(), "users.yaml")
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte(`
+users:
+  - name: john
+    password: mypass
+    run_as: handy-sshd-unknown-user
+`), 0600))
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{"--users-file", usersFilePath})
+	assert.ErrorContains(t, rootCmd.Execute(), `run_as of user "john"`)
+}
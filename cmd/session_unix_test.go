@@ -0,0 +1,250 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExecWithPty(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass", "--shell", "sh")
+	client, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	assert.NoError(t, session.RequestPty("vt100", 40, 120, ssh.TerminalModes{}))
+	output, err := session.Output(`sh -c "test -t 0 && test -t 1 && echo $TERM && stty size"`)
+	assert.NoError(t, err)
+	assert.Equal(t, "vt100\r\n40 120\r\n", string(output))
+
+	// The exit code of the command is sent
+	session, err = client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	assert.NoError(t, session.RequestPty("xterm", 40, 120, ssh.TerminalModes{}))
+	err = session.Run(`sh -c "exit 3"`)
+	assert.IsType(t, &ssh.ExitError{}, err)
+	assert.Equal(t, 3, err.(*ssh.ExitError).ExitStatus())
+
+	// No pty without pty-req
+	session, err = client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	output, err = session.Output(`sh -c "test -t 1 || echo notty"`)
+	assert.NoError(t, err)
+	assert.Equal(t, "notty\n", string(output))
+}
+
+func TestPtyShellStartsOnShellRequest(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass", "--shell", "sh")
+	client, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	assert.NoError(t, session.RequestPty("xterm", 40, 120, ssh.TerminalModes{}))
+	// The size changed before the shell starts is used
+	assert.NoError(t, session.WindowChange(30, 90))
+	var stdout strings.Builder
+	session.Stdout = &stdout
+	stdin, err := session.StdinPipe()
+	assert.NoError(t, err)
+	assert.NoError(t, session.Shell())
+	_, err = stdin.Write([]byte("stty size; exit 0\r"))
+	assert.NoError(t, err)
+	assert.NoError(t, session.Wait())
+	assert.Contains(t, stdout.String(), "30 90\r\n")
+}
+
+func TestShellWithoutPty(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass", "--shell", "sh")
+	client, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	session.Stdin = strings.NewReader("test -t 0 || echo notty\necho hello''world\nexit 5\n")
+	var stdout strings.Builder
+	session.Stdout = &stdout
+	assert.NoError(t, session.Shell())
+	err = session.Wait()
+	assert.IsType(t, &ssh.ExitError{}, err)
+	assert.Equal(t, 5, err.(*ssh.ExitError).ExitStatus())
+	assert.Equal(t, "notty\nhelloworld\n", stdout.String())
+}
+
+func TestExecStderr(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass")
+	client, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	var stdout, stderr strings.Builder
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	assert.NoError(t, session.Run(`sh -c "echo out; echo err >&2; echo out2"`))
+	assert.Equal(t, "out\nout2\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+
+	// All output is received before the exit status
+	session, err = client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	stdout.Reset()
+	stderr.Reset()
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = session.Run(`sh -c "head -c 1000000 /dev/zero; head -c 300000 /dev/zero >&2; exit 2"`)
+	assert.IsType(t, &ssh.ExitError{}, err)
+	assert.Equal(t, 2, err.(*ssh.ExitError).ExitStatus())
+	assert.Equal(t, 1000000, stdout.Len())
+	assert.Equal(t, 300000, stderr.Len())
+}
+
+func TestExecStdinEOF(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass")
+	client, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	session.Stdin = strings.NewReader("a\nb\nc\n")
+	output, err := session.Output("wc -l")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", strings.TrimSpace(string(output)))
+
+	// The shell without a pty exits at the end of input
+	session, err = client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	session.Stdin = strings.NewReader("echo hello")
+	var stdout strings.Builder
+	session.Stdout = &stdout
+	assert.NoError(t, session.Shell())
+	assert.NoError(t, session.Wait())
+	assert.Equal(t, "hello\n", stdout.String())
+}
+
+func TestExecCommandNotFound(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass")
+	client, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	var stderr strings.Builder
+	session.Stderr = &stderr
+	err = session.Run("handy-sshd-test-no-such-command")
+	assert.IsType(t, &ssh.ExitError{}, err)
+	assert.Equal(t, 127, err.(*ssh.ExitError).ExitStatus())
+	assert.Contains(t, stderr.String(), "handy-sshd-test-no-such-command")
+
+	// Not executable
+	notExecutablePath := path.Join(t.TempDir(), "not-executable")
+	assert.NoError(t, os.WriteFile(notExecutablePath, []byte("#!/bin/sh\n"), 0644))
+	session, err = client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	stderr.Reset()
+	session.Stderr = &stderr
+	err = session.Run(notExecutablePath)
+	assert.IsType(t, &ssh.ExitError{}, err)
+	assert.Equal(t, 126, err.(*ssh.ExitError).ExitStatus())
+	assert.Contains(t, stderr.String(), "permission denied")
+}
+
+// startSessionProcess starts the command printing its PID and returns the PID
+func startSessionProcess(t *testing.T, session *ssh.Session, command string) int {
+	stdout, err := session.StdoutPipe()
+	assert.NoError(t, err)
+	assert.NoError(t, session.Start(command))
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	assert.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	assert.NoError(t, err)
+	return pid
+}
+
+func assertProcessExits(t *testing.T, pid int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			assert.Fail(t, "process still running", "pid %d", pid)
+			syscall.Kill(pid, syscall.SIGKILL)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestCloseSessionTerminatesProcess(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass", "--close-grace-period", "500ms")
+	client, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer client.Close()
+
+	// SIGHUP
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	pid := startSessionProcess(t, session, `sh -c "echo $$; exec sleep 60"`)
+	session.Close()
+	assertProcessExits(t, pid, 400*time.Millisecond)
+
+	// SIGKILL after the grace period when SIGHUP is ignored
+	session, err = client.NewSession()
+	assert.NoError(t, err)
+	pid = startSessionProcess(t, session, `sh -c "trap '' HUP; echo $$; while true; do sleep 1; done"`)
+	session.Close()
+	time.Sleep(200 * time.Millisecond)
+	assert.NoError(t, syscall.Kill(pid, 0))
+	assertProcessExits(t, pid, 3*time.Second)
+
+	// With a pty
+	session, err = client.NewSession()
+	assert.NoError(t, err)
+	assert.NoError(t, session.RequestPty("xterm", 40, 120, ssh.TerminalModes{}))
+	pid = startSessionProcess(t, session, `sh -c "echo $$; exec sleep 60"`)
+	session.Close()
+	assertProcessExits(t, pid, 400*time.Millisecond)
+}
+
+func TestPtyTerminalModes(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass")
+	client, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	// ^X as the interrupt character and no echo
+	assert.NoError(t, session.RequestPty("xterm", 40, 80, ssh.TerminalModes{ssh.VINTR: 0x18, ssh.ECHO: 0, ssh.ICANON: 1}))
+	output, err := session.Output("stty -a")
+	assert.NoError(t, err)
+	assert.Contains(t, string(output), "intr = ^X")
+	assert.Contains(t, string(output), "-echo ")
+	assert.NotContains(t, string(output), "-icanon")
+}
@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"github.com/nwtgck/handy-sshd"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// Replaced in tests because the test binary is not executable by other users
+var sftpHelperExecutable = os.Executable
+
+// sftpServerCmd is the helper process of SFTP running as the user of a session
+func sftpServerCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:          "sftp-server",
+		Short:        "Serve SFTP on stdin and stdout (internal use)",
+		Hidden:       true,
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return handy_sshd.ServeSftp(os.Stdin, os.Stdout)
+		},
+	}
+}
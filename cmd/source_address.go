@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// sourceAddressFilter checks source IPs of connections with --allow-from and --deny-from
+type sourceAddressFilter struct {
+	// Empty means all addresses
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+func newSourceAddressFilter(allowFrom []string, denyFrom []string) (*sourceAddressFilter, error) {
+	var filter sourceAddressFilter
+	var err error
+	if filter.allowed, err = parseIPNets(allowFrom); err != nil {
+		return nil, fmt.Errorf("invalid --allow-from: %w", err)
+	}
+	if filter.denied, err = parseIPNets(denyFrom); err != nil {
+		return nil, fmt.Errorf("invalid --deny-from: %w", err)
+	}
+	return &filter, nil
+}
+
+// parseIPNets parses CIDR addresses. An IP address without prefix length is the single address.
+func parseIPNets(addresses []string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, err
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// allows returns true if the connection from the address is accepted. Denied addresses take precedence. Connections not over TCP (e.g. Unix domain socket) are always accepted.
+func (f *sourceAddressFilter) allows(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	contains := func(ipNets []*net.IPNet) bool {
+		for _, ipNet := range ipNets {
+			if ipNet.Contains(tcpAddr.IP) {
+				return true
+			}
+		}
+		return false
+	}
+	if contains(f.denied) {
+		return false
+	}
+	return len(f.allowed) == 0 || contains(f.allowed)
+}
+
+// validateFromPattern validates a pattern of from="..." of authorized_keys. Patterns with "/" are CIDR addresses.
+func validateFromPattern(pattern string) error {
+	address := strings.TrimPrefix(pattern, "!")
+	if address == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	if strings.Contains(address, "/") {
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAllowFromDenyFrom(t *testing.T) {
+	for _, args := range [][]string{
+		{"--allow-from", "127.0.0.1"},
+		{"--allow-from", "10.0.0.0/8,127.0.0.0/8"},
+		{"--deny-from", "10.0.0.0/8"},
+	} {
+		address := startServer(t, append([]string{"--user", "john:mypass"}, args...)...)
+		client, err := dialWithPassword(address, "john", "mypass")
+		assert.NoError(t, err, args)
+		if err == nil {
+			client.Close()
+		}
+	}
+	for _, args := range [][]string{
+		{"--allow-from", "10.0.0.0/8"},
+		{"--allow-from", "127.0.0.0/8", "--deny-from", "127.0.0.1/32"},
+		{"--deny-from", "::/0,0.0.0.0/0"},
+	} {
+		address := startServer(t, append([]string{"--user", "john:mypass"}, args...)...)
+		// Refused before the handshake
+		conn, err := net.Dial("tcp", address)
+		assert.NoError(t, err)
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err, args)
+		conn.Close()
+	}
+}
+
+func TestInvalidAllowFrom(t *testing.T) {
+	rootCmd := RootCmd()
+	rootCmd.SetArgs([]string{"--user", "john:mypass", "--allow-from", "10.0.0.0/33"})
+	var stderrBuf bytes.Buffer
+	rootCmd.SetErr(&stderrBuf)
+	assert.Error(t, rootCmd.Execute())
+	assert.Contains(t, stderrBuf.String(), "invalid --allow-from")
+}
+
+func TestUserFrom(t *testing.T) {
+	address := startServer(t, "--user", "john:mypass", "--user", "alice:mypass", "--user-from", "john:10.0.0.0/8", "--user-from", "alice:127.0.0.0/8,!10.*")
+	_, err := dialWithPassword(address, "john", "mypass")
+	assert.Error(t, err)
+	client, err := dialWithPassword(address, "alice", "mypass")
+	assert.NoError(t, err)
+	if err == nil {
+		client.Close()
+	}
+}
+
+func TestInvalidUserFrom(t *testing.T) {
+	for _, args := range [][]string{
+		{"--user-from", "john:10.0.0.0/33"},
+		{"--user-from", "john"},
+		{"--user-from", "alice:10.0.0.0/8"},
+	} {
+		rootCmd := RootCmd()
+		rootCmd.SetArgs(append([]string{"--user", "john:mypass"}, args...))
+		var stderrBuf bytes.Buffer
+		rootCmd.SetErr(&stderrBuf)
+		assert.Error(t, rootCmd.Execute(), args)
+		assert.Contains(t, stderrBuf.String(), "--user-from", args)
+	}
+}
+
+func TestUsersFileFrom(t *testing.T) {
+	usersFilePath := path.Join(t.TempDir(), "users.yaml")
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte(`
+users:
+  - name: john
+    password: mypass
+    from: ["10.0.0.0/8"]
+  - name: alice
+    password: mypass
+    from: ["127.0.0.0/8", "!10.*"]
+  - name: bob
+    password: mypass
+    from: ["127.0.0.*", "!127.0.0.1"]
+`), 0600))
+	address := startUsersFileServer(t, usersFilePath)
+	_, err := dialWithPassword(address, "john", "mypass")
+	assert.Error(t, err)
+	client, err := dialWithPassword(address, "alice", "mypass")
+	assert.NoError(t, err)
+	if err == nil {
+		client.Close()
+	}
+	_, err = dialWithPassword(address, "bob", "mypass")
+	assert.Error(t, err)
+}
+
+func TestUsersFileInvalidFrom(t *testing.T) {
+	usersFilePath := path.Join(t.TempDir(), "users.yaml")
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte(`
+users:
+  - name: john
+    password: mypass
+    from: ["10.0.0.0/33"]
+`), 0600))
+	_, err := loadUsersFile(usersFilePath)
+	assert.ErrorContains(t, err, `from of user "john"`)
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/nwtgck/handy-sshd"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Variables to be replaced in tests
+var (
+	passwdPath = "/etc/passwd"
+	shadowPath = "/etc/shadow"
+)
+
+// systemAccount is a local account in /etc/passwd
+type systemAccount struct {
+	uid           uint32
+	homeDirectory string
+	shell         string
+}
+
+// systemUserSource provides users of local accounts. The files are parsed again when they are modified so that changes by useradd(8) and passwd(1) are applied without restart.
+type systemUserSource struct {
+	passwdPath string
+	shadowPath string
+
+	mu          sync.Mutex
+	cachedUsers []sshUser
+	cacheKey    systemUsersCacheKey
+}
+
+// systemUsersCacheKey identifies the contents of passwd and shadow on the day (accounts expire by day)
+type systemUsersCacheKey struct {
+	passwdModTime time.Time
+	passwdSize    int64
+	shadowModTime time.Time
+	shadowSize    int64
+	day           int64
+}
+
+// users returns the users in passwd with password hashes in shadow. Passwords are not available when shadow is not readable (e.g. not running as root).
+func (s *systemUserSource) users() ([]sshUser, error) {
+	now := time.Now()
+	passwdStat, err := os.Stat(s.passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	key := systemUsersCacheKey{passwdModTime: passwdStat.ModTime(), passwdSize: passwdStat.Size(), day: now.Unix() / (24 * 60 * 60)}
+	if shadowStat, err := os.Stat(s.shadowPath); err == nil {
+		key.shadowModTime, key.shadowSize = shadowStat.ModTime(), shadowStat.Size()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cachedUsers != nil && s.cacheKey == key {
+		return s.cachedUsers, nil
+	}
+	users, err := s.parse(now)
+	if err != nil {
+		return nil, err
+	}
+	s.cachedUsers, s.cacheKey = users, key
+	return users, nil
+}
+
+func (s *systemUserSource) parse(now time.Time) ([]sshUser, error) {
+	passwd, err := os.ReadFile(s.passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	shadow, err := os.ReadFile(s.shadowPath)
+	if err != nil {
+		shadow = nil
+	}
+	entries := parseShadow(shadow, now)
+	users := []sshUser{}
+	scanner := bufio.NewScanner(bytes.NewReader(passwd))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(line, ":")
+		if len(fields) != 7 {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		entry := entries[fields[0]]
+		if entry.expired {
+			continue
+		}
+		user := sshUser{
+			name:    fields[0],
+			account: &systemAccount{uid: uint32(uid), homeDirectory: fields[5], shell: fields[6]},
+			runAs:   fields[0],
+		}
+		// Passwords of root are not accepted in the same way as "PermitRootLogin prohibit-password" of OpenSSH
+		if uid != 0 {
+			user.password = entry.passwordHash
+			user.passwordHashed = true
+		}
+		if fields[5] != "" {
+			user.authorizedKeysSources = []authorizedKeysSource{&authorizedKeysFile{path: filepath.Join(fields[5], ".ssh", "authorized_keys"), optional: true}}
+		}
+		users = append(users, user)
+	}
+	return users, scanner.Err()
+}
+
+type shadowEntry struct {
+	// Empty when the password is locked, empty or unsupported
+	passwordHash string
+	expired      bool
+}
+
+// parseShadow returns entries by user names
+func parseShadow(shadow []byte, now time.Time) map[string]shadowEntry {
+	entries := map[string]shadowEntry{}
+	today := now.Unix() / (24 * 60 * 60)
+	scanner := bufio.NewScanner(bytes.NewReader(shadow))
+	for scanner.Scan() {
+		// name:password:lastchg:min:max:warn:inactive:expire:reserved
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 2 {
+			continue
+		}
+		var entry shadowEntry
+		// Locked ("!..." or "*") or empty passwords are not hashes. Only the syntax is validated not to compute hashes of all accounts.
+		if handy_sshd.IsPasswordHash(fields[1]) && handy_sshd.ValidatePasswordHash(fields[1]) == nil {
+			entry.passwordHash = fields[1]
+		}
+		// The account expires on the day (days since 1970-01-01)
+		if len(fields) >= 8 && fields[7] != "" {
+			if expire, err := strconv.ParseInt(fields[7], 10, 64); err == nil && today >= expire {
+				entry.expired = true
+			}
+		}
+		entries[fields[0]] = entry
+	}
+	return entries
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSystemUsersCache(t *testing.T) {
+	dir := t.TempDir()
+	source := &systemUserSource{passwdPath: path.Join(dir, "passwd"), shadowPath: path.Join(dir, "shadow")}
+	assert.NoError(t, os.WriteFile(source.passwdPath, []byte("john:x:1000:1000::/home/john:/bin/sh\n"), 0644))
+	assert.NoError(t, os.WriteFile(source.shadowPath, []byte("john:$1$saltsalt$6l6q78pgx7P4rrtE8mRi8/:19000:0:99999:7:::\n"), 0600))
+	users, err := source.users()
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+	assert.Equal(t, "$1$saltsalt$6l6q78pgx7P4rrtE8mRi8/", users[0].password)
+	// Not parsed again while the files are not modified
+	cachedUsers, err := source.users()
+	assert.NoError(t, err)
+	assert.Same(t, &users[0], &cachedUsers[0])
+
+	assert.NoError(t, os.WriteFile(source.shadowPath, []byte("john:$5$abc$HHlb8QMClR55.dRTU4JXNgHGkR1U6jlbNtlfDN528y0:19000:0:99999:7:::\n"), 0600))
+	users, err = source.users()
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+	assert.Equal(t, "$5$abc$HHlb8QMClR55.dRTU4JXNgHGkR1U6jlbNtlfDN528y0", users[0].password)
+}
@@ -0,0 +1,100 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"testing"
+)
+
+func TestSystemUsers(t *testing.T) {
+	dir := t.TempDir()
+	johnHome := path.Join(dir, "john")
+	assert.NoError(t, os.MkdirAll(path.Join(johnHome, ".ssh"), 0700))
+	johnSigner, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path.Join(johnHome, ".ssh", "authorized_keys"), ssh.MarshalAuthorizedKey(johnSigner.PublicKey()), 0600))
+	loginShell := path.Join(dir, "login-shell")
+	assert.NoError(t, os.WriteFile(loginShell, []byte("#!/bin/sh\necho \"login shell in $(pwd)\"\nsleep 1\n"), 0700))
+	oldPasswdPath, oldShadowPath := passwdPath, shadowPath
+	passwdPath, shadowPath = path.Join(dir, "passwd"), path.Join(dir, "shadow")
+	t.Cleanup(func() {
+		passwdPath, shadowPath = oldPasswdPath, oldShadowPath
+	})
+	// The current user plays "john" because sessions run as the user in the real /etc/passwd. The uid is not 0 so that the password is accepted.
+	current, err := user.Current()
+	assert.NoError(t, err)
+	john := current.Username
+	assert.NoError(t, os.WriteFile(passwdPath, []byte(fmt.Sprintf(`toor:x:0:0:root:%[1]s:/bin/sh
+%[3]s:x:1000:1000:John:%[1]s:%[2]s
+locked:x:1001:1001::%[1]s:/bin/sh
+expired:x:1002:1002::%[1]s:/bin/sh
+nopassword:x:1003:1003::/nonexistent:/bin/sh
+`, johnHome, loginShell, john)), 0644))
+	// All passwords are "mypass" (yescrypt, sha512-crypt, md5-crypt)
+	assert.NoError(t, os.WriteFile(shadowPath, []byte(`toor:$1$saltsalt$6l6q78pgx7P4rrtE8mRi8/:19000:0:99999:7:::
+`+john+`:$y$j9T$abcdefghijklmnop$lLbHPeMbpx4Zz.Af89L/4L9UGkb.3P.pK3DaNB5xNe2:19000:0:99999:7:::
+locked:!$1$saltsalt$6l6q78pgx7P4rrtE8mRi8/:19000:0:99999:7:::
+expired:$1$saltsalt$6l6q78pgx7P4rrtE8mRi8/:19000:0:99999:7::1:
+nopassword::19000:0:99999:7:::
+`), 0600))
+	address := startServer(t, "--system-users", "--allow-execute", "--auth-failures-limit", "0")
+
+	johnClient, err := dialWithPassword(address, john, "mypass")
+	assert.NoError(t, err)
+	defer johnClient.Close()
+	session, err := johnClient.NewSession()
+	assert.NoError(t, err)
+	output, err := session.Output("pwd")
+	assert.NoError(t, err)
+	assert.Equal(t, johnHome+"\n", string(output))
+	assertLoginShell(t, johnClient, "login shell in "+johnHome)
+
+	_, err = dialWithPassword(address, john, "mywrongpassword")
+	assert.Error(t, err)
+	johnKeyClient, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            john,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(johnSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	johnKeyClient.Close()
+
+	for _, user := range []string{"toor", "locked", "expired", "nopassword", "unknown"} {
+		_, err = dialWithPassword(address, user, "mypass")
+		assert.Error(t, err, user)
+		_, err = dialWithPassword(address, user, "")
+		assert.Error(t, err, user)
+	}
+}
+
+// assertLoginShell asserts that the shell with a pty outputs the expected string
+func assertLoginShell(t *testing.T, client *ssh.Client, expected string) {
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	assert.NoError(t, session.RequestPty("xterm", 100, 200, ssh.TerminalModes{}))
+	stdout, err := session.StdoutPipe()
+	assert.NoError(t, err)
+	stdoutBytesChan := make(chan []byte)
+	go func() {
+		var buff bytes.Buffer
+		io.Copy(&buff, stdout)
+		stdoutBytesChan <- buff.Bytes()
+	}()
+	// stdin is kept open because the end of input closes the session
+	stdin, err := session.StdinPipe()
+	assert.NoError(t, err)
+	defer stdin.Close()
+	assert.NoError(t, session.Shell())
+	// The session is closed when the login shell exits
+	assert.NoError(t, session.Wait())
+	assert.Contains(t, string(<-stdoutBytesChan), expected)
+}
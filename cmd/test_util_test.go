@@ -2,6 +2,13 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"github.com/google/uuid"
 	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/assert"
@@ -25,6 +32,22 @@ func getAvailableTcpPort() int {
 	return ln.Addr().(*net.TCPAddr).Port
 }
 
+// startServer starts the server on an available port and returns the address
+func startServer(t *testing.T, args ...string) string {
+	rootCmd := RootCmd()
+	port := getAvailableTcpPort()
+	rootCmd.SetArgs(append([]string{"--port", strconv.Itoa(port)}, args...))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		var stderrBuf bytes.Buffer
+		rootCmd.SetErr(&stderrBuf)
+		rootCmd.ExecuteContext(ctx)
+	}()
+	waitTCPServer(port)
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
 func waitTCPServer(port int) {
 	for {
 		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
@@ -53,6 +76,11 @@ func assertNoExec(t *testing.T, client *ssh.Client) {
 	_, err = session.Output("whoami")
 	assert.Error(t, err)
 	assert.Equal(t, "ssh: command whoami failed", err.Error())
+
+	session, err = client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	assert.EqualError(t, session.Shell(), "ssh: could not start shell")
 }
 
 func assertPtyTerminal(t *testing.T, client *ssh.Client) {
@@ -281,3 +309,35 @@ func assertNoSftp(t *testing.T, client *ssh.Client) {
 	assert.Error(t, err)
 	assert.Equal(t, "ssh: subsystem request failed", err.Error())
 }
+
+func generateEd25519Key(t *testing.T) crypto.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	return privateKey
+}
+
+func generateEcdsaKey(t *testing.T) crypto.Signer {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return privateKey
+}
+
+func generateRsaKey(t *testing.T) crypto.Signer {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	return privateKey
+}
+
+func writeAuthorizedKeys(t *testing.T, signers ...ssh.Signer) string {
+	var authorizedKeys []byte
+	for _, signer := range signers {
+		authorizedKeys = append(authorizedKeys, ssh.MarshalAuthorizedKey(signer.PublicKey())...)
+	}
+	authorizedKeysPath := path.Join(t.TempDir(), "authorized_keys")
+	assert.NoError(t, os.WriteFile(authorizedKeysPath, authorizedKeys, 0600))
+	return authorizedKeysPath
+}
+
+func authorizedKeyLine(options string, signer ssh.Signer) string {
+	return options + " " + string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+}
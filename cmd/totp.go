@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"github.com/nwtgck/handy-sshd"
+	"sync"
+	"time"
+)
+
+const totpPrompt = "Verification code: "
+
+// totpVerifier verifies TOTP codes and rejects codes already used by the same user
+type totpVerifier struct {
+	mu sync.Mutex
+	// user name -> last used time step
+	lastSteps map[string]int64
+}
+
+func newTotpVerifier() *totpVerifier {
+	return &totpVerifier{lastSteps: map[string]int64{}}
+}
+
+func (v *totpVerifier) verify(user *sshUser, code string) bool {
+	step, ok := handy_sshd.VerifyTotp(user.totpSecret, code, time.Now())
+	if !ok {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if lastStep, ok := v.lastSteps[user.name]; ok && step <= lastStep {
+		return false
+	}
+	v.lastSteps[user.name] = step
+	return true
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"encoding/base32"
+	"fmt"
+	"github.com/nwtgck/handy-sshd"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTotpCode(t *testing.T) {
+	// Test vectors in RFC 6238 (the last 6 digits)
+	key := []byte("12345678901234567890")
+	for unixTime, expected := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		assert.Equal(t, expected, handy_sshd.TotpCode(key, handy_sshd.TotpStep(time.Unix(unixTime, 0))))
+	}
+}
+
+func TestTotp(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := base32.StdEncoding.EncodeToString(key)
+	signer, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	usersFilePath := path.Join(t.TempDir(), "users.yaml")
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte(fmt.Sprintf(`
+users:
+  - name: john
+    authorized_keys: ['%[1]s']
+    totp_secret: '%[2]s'
+  - name: alice
+    password: mypass
+    totp_secret: '%[2]s'
+  - name: bob
+    password: mypass
+    totp_secret: '%[2]s'
+`, authorizedKey, secret)), 0600))
+	address := startUsersFileServer(t, usersFilePath)
+	code := handy_sshd.TotpCode(key, handy_sshd.TotpStep(time.Now()))
+	keyboardInteractive := func(answers map[string]string) ssh.AuthMethod {
+		return ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			var result []string
+			for _, question := range questions {
+				result = append(result, answers[question])
+			}
+			return result, nil
+		})
+	}
+	dial := func(user string, authMethods ...ssh.AuthMethod) error {
+		client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+			User:            user,
+			Auth:            authMethods,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	}
+
+	// One factor alone is not enough
+	assert.Error(t, dial("john", ssh.PublicKeys(signer)))
+	assert.Error(t, dial("john", keyboardInteractive(map[string]string{"Verification code: ": code})))
+	assert.Error(t, dial("alice", ssh.Password("mypass")))
+	assert.Error(t, dial("alice", keyboardInteractive(map[string]string{"Password: ": "mypass"})))
+	// Wrong code
+	assert.Error(t, dial("john", ssh.PublicKeys(signer), keyboardInteractive(map[string]string{"Verification code: ": "000000"})))
+
+	// Public key + TOTP
+	assert.NoError(t, dial("john", ssh.PublicKeys(signer), keyboardInteractive(map[string]string{"Verification code: ": code})))
+	// The used code is rejected
+	assert.Error(t, dial("john", ssh.PublicKeys(signer), keyboardInteractive(map[string]string{"Verification code: ": code})))
+
+	// Password + TOTP
+	assert.NoError(t, dial("alice", ssh.Password("mypass"), keyboardInteractive(map[string]string{"Verification code: ": code})))
+
+	// Both in keyboard-interactive
+	assert.Error(t, dial("bob", keyboardInteractive(map[string]string{"Password: ": "mywrongpass", "Verification code: ": code})))
+	assert.NoError(t, dial("bob", keyboardInteractive(map[string]string{"Password: ": "mypass", "Verification code: ": code})))
+}
+
+func TestTotpOnlyRejected(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	signer, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	for _, user := range []string{
+		fmt.Sprintf(`{name: john, totp_secret: '%s'}`, secret),
+		fmt.Sprintf(`{name: john, authorized_keys: ['%s'], totp_secret: '%s', authentication_methods: ["keyboard-interactive"]}`, authorizedKey, secret),
+	} {
+		usersFilePath := path.Join(t.TempDir(), "users.yaml")
+		assert.NoError(t, os.WriteFile(usersFilePath, []byte("users:\n  - "+user+"\n"), 0600))
+		_, err := loadUsersFile(usersFilePath)
+		assert.ErrorContains(t, err, `of user "john"`, user)
+	}
+}
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/nwtgck/handy-sshd"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"os/signal"
+	osuser "os/user"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const usersFilePollInterval = 2 * time.Second
+
+// usersFileType is the format of --users-file
+type usersFileType struct {
+	Users []usersFileUserType `yaml:"users"`
+}
+
+type usersFileUserType struct {
+	Name string `yaml:"name"`
+	// Password hash or plain password
+	Password string `yaml:"password"`
+	// Lines in authorized_keys format
+	AuthorizedKeys      []string          `yaml:"authorized_keys"`
+	AuthorizedKeysFiles []string          `yaml:"authorized_keys_files"`
+	ForceCommand        string            `yaml:"force_command"`
+	Environment         map[string]string `yaml:"environment"`
+	// Permissions replacing --allow-* flags (e.g. [tcpip-forward, direct-tcpip])
+	Permissions *[]string `yaml:"permissions"`
+	// Base32 TOTP secret required as the second factor
+	TotpSecret string `yaml:"totp_secret"`
+	// Chains of authentication methods as AuthenticationMethods of OpenSSH (e.g. ["publickey,password", "publickey,keyboard-interactive"])
+	AuthenticationMethods []string `yaml:"authentication_methods"`
+	// OS user which sessions run as (requires root)
+	RunAs string `yaml:"run_as"`
+	// Source addresses as from="..." of authorized_keys (e.g. ["10.8.0.0/16", "!10.8.5.*"])
+	From []string `yaml:"from"`
+}
+
+// loadUsersFile loads users in the users file. Authorized keys files in it are read to fail fast.
+func loadUsersFile(path string) ([]sshUser, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var usersFile usersFileType
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&usersFile); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	var users []sshUser
+	for i, u := range usersFile.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("%s: name of users[%d] is empty", path, i)
+		}
+		user := sshUser{name: u.Name, password: u.Password, passwordHashed: handy_sshd.IsPasswordHash(u.Password), forceCommand: u.ForceCommand}
+		if user.passwordHashed {
+			if err := handy_sshd.ValidatePasswordHash(u.Password); err != nil {
+				return nil, fmt.Errorf("%s: invalid password hash of user %q: %w", path, u.Name, err)
+			}
+		}
+		if len(u.AuthorizedKeys) != 0 {
+			source := &authorizedKeysList{name: fmt.Sprintf("%s (%s)", path, u.Name)}
+			for _, line := range u.AuthorizedKeys {
+				keys := parseAuthorizedKeys([]byte(line))
+				if len(keys) != 1 {
+					return nil, fmt.Errorf("%s: invalid authorized key of user %q: %s", path, u.Name, line)
+				}
+				source.keys = append(source.keys, keys[0])
+			}
+			user.authorizedKeysSources = append(user.authorizedKeysSources, source)
+		}
+		for _, authorizedKeysFilePath := range u.AuthorizedKeysFiles {
+			source := &authorizedKeysFile{path: authorizedKeysFilePath}
+			if _, err := source.authorizedKeys(); err != nil {
+				return nil, fmt.Errorf("%s: failed to load authorized keys of user %q: %w", path, u.Name, err)
+			}
+			user.authorizedKeysSources = append(user.authorizedKeysSources, source)
+		}
+		if u.TotpSecret != "" {
+			user.totpSecret, err = handy_sshd.ParseTotpSecret(u.TotpSecret)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w of user %q", path, err, u.Name)
+			}
+		}
+		if u.RunAs != "" {
+			if _, err := osuser.Lookup(u.RunAs); err != nil {
+				return nil, fmt.Errorf("%s: run_as of user %q: %w", path, u.Name, err)
+			}
+			user.runAs = u.RunAs
+		}
+		if len(u.From) != 0 {
+			for _, pattern := range u.From {
+				if err := validateFromPattern(pattern); err != nil {
+					return nil, fmt.Errorf("%s: from of user %q: %w", path, u.Name, err)
+				}
+			}
+			user.from = strings.Join(u.From, ",")
+		}
+		if len(u.AuthenticationMethods) != 0 {
+			user.authenticationMethods, err = parseAuthenticationMethods(u.AuthenticationMethods)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w of user %q", path, err, u.Name)
+			}
+		}
+		if err := user.validateTotpFactors(); err != nil {
+			return nil, fmt.Errorf("%s: %w of user %q", path, err, u.Name)
+		}
+		if u.Permissions != nil {
+			user.allowedPermissions = []string{}
+			for _, permission := range *u.Permissions {
+				if !slices.Contains(handy_sshd.PermissionNames, permission) {
+					return nil, fmt.Errorf("%s: unknown permission of user %q: %s (%s)", path, u.Name, permission, strings.Join(handy_sshd.PermissionNames, ", "))
+				}
+				user.allowedPermissions = append(user.allowedPermissions, permission)
+			}
+		}
+		// Sort for stable order
+		var names []string
+		for name := range u.Environment {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			user.environment = append(user.environment, name+"="+u.Environment[name])
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// userStore holds users of --user, --users-file and --system-users. Users in the file are replaced on reload and new authentications see them immediately.
+type userStore struct {
+	flagUsers []sshUser
+	fileUsers atomic.Pointer[[]sshUser]
+	usersFile string
+	// nil without --system-users
+	systemUsers *systemUserSource
+	logger      *slog.Logger
+}
+
+func (s *userStore) users() []sshUser {
+	fileUsers := s.fileUsers.Load()
+	if fileUsers == nil && s.systemUsers == nil {
+		return s.flagUsers
+	}
+	users := append([]sshUser{}, s.flagUsers...)
+	if fileUsers != nil {
+		users = append(users, *fileUsers...)
+	}
+	if s.systemUsers != nil {
+		systemUsers, err := s.systemUsers.users()
+		if err != nil {
+			s.logger.Error("failed to load system users", "err", err)
+		}
+		users = append(users, systemUsers...)
+	}
+	return users
+}
+
+func (s *userStore) load() error {
+	users, err := loadUsersFile(s.usersFile)
+	if err != nil {
+		return err
+	}
+	s.fileUsers.Store(&users)
+	return nil
+}
+
+// watch reloads the users file when it is modified or SIGHUP is received until stop is closed. The previous users are kept when the file is invalid.
+func (s *userStore) watch(stop <-chan struct{}) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sighup)
+		lastStat, _ := os.Stat(s.usersFile)
+		ticker := time.NewTicker(usersFilePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-sighup:
+				s.logger.Info("SIGHUP received")
+			case <-ticker.C:
+				stat, err := os.Stat(s.usersFile)
+				if err != nil || (lastStat != nil && stat.ModTime().Equal(lastStat.ModTime()) && stat.Size() == lastStat.Size()) {
+					continue
+				}
+			}
+			lastStat, _ = os.Stat(s.usersFile)
+			if err := s.load(); err != nil {
+				s.logger.Error("failed to reload users file (previous users kept)", "path", s.usersFile, "err", err)
+				continue
+			}
+			s.logger.Info("users file reloaded", "path", s.usersFile, "users", len(*s.fileUsers.Load()))
+		}
+	}()
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nwtgck/handy-sshd"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startUsersFileServer(t *testing.T, usersFilePath string, extraArgs ...string) string {
+	return startServer(t, append([]string{"--users-file", usersFilePath}, extraArgs...)...)
+}
+
+func dialWithPassword(address string, user string, password string) (*ssh.Client, error) {
+	return ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+}
+
+func TestUsersFile(t *testing.T) {
+	passwordHash, err := handy_sshd.HashPassword(handy_sshd.PasswordHashBcrypt, []byte("mypass"))
+	assert.NoError(t, err)
+	aliceSigner, err := ssh.NewSignerFromSigner(generateEd25519Key(t))
+	assert.NoError(t, err)
+	usersFilePath := path.Join(t.TempDir(), "users.yaml")
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte(fmt.Sprintf(`
+users:
+  - name: john
+    password: '%s'
+  - name: alice
+    authorized_keys:
+      - '%s'
+    force_command: sh -c 'echo "$HANDY_SSHD_TEST1 $HANDY_SSHD_TEST2"'
+    environment:
+      HANDY_SSHD_TEST1: hello
+      HANDY_SSHD_TEST2: world
+`, passwordHash, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(aliceSigner.PublicKey()))))), 0600))
+	address := startUsersFileServer(t, usersFilePath)
+
+	johnClient, err := dialWithPassword(address, "john", "mypass")
+	assert.NoError(t, err)
+	defer johnClient.Close()
+	assertExec(t, johnClient)
+	_, err = dialWithPassword(address, "john", "mywrongpassword")
+	assert.Error(t, err)
+
+	aliceClient, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(aliceSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	session, err := aliceClient.NewSession()
+	assert.NoError(t, err)
+	output, err := session.Output("whoami")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world\n", string(output))
+	aliceClient.Close()
+	_, err = dialWithPassword(address, "alice", "")
+	assert.Error(t, err)
+
+	// Replace john with bob
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte(fmt.Sprintf(`
+users:
+  - name: bob
+    password: '%s'
+`, passwordHash)), 0600))
+	assert.Eventually(t, func() bool {
+		client, err := dialWithPassword(address, "bob", "mypass")
+		if err != nil {
+			return false
+		}
+		client.Close()
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+	_, err = dialWithPassword(address, "john", "mypass")
+	assert.Error(t, err)
+	// The existing connection is not affected
+	assertExec(t, johnClient)
+
+	// Previous users are kept when the file is invalid
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte("users: [{name: bob, unknown_field: 1}]"), 0600))
+	time.Sleep(2 * usersFilePollInterval)
+	client, err := dialWithPassword(address, "bob", "mypass")
+	assert.NoError(t, err)
+	client.Close()
+}
+
+func TestInvalidUsersFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, content := range []string{
+		"users: [{password: mypass}]",
+		"users: [{name: john, passwd: mypass}]",
+		"users: [{name: john, password: '$2a$10$invalid'}]",
+		"users: [{name: john, authorized_keys: ['invalid key']}]",
+		"users: [{name: john, authorized_keys_files: [/path/to/non-existent]}]",
+		"users: [{name: john, permissions: [shell]}]",
+		"users: [{name: john, password: mypass, authentication_methods: ['publickey,otp']}]",
+	} {
+		usersFilePath := path.Join(dir, "users.yaml")
+		assert.NoError(t, os.WriteFile(usersFilePath, []byte(content), 0600))
+		rootCmd := RootCmd()
+		rootCmd.SetArgs([]string{"--users-file", usersFilePath})
+		rootCmd.SetErr(&bytes.Buffer{})
+		assert.Error(t, rootCmd.Execute(), content)
+	}
+}
+
+func TestUsersFilePermissions(t *testing.T) {
+	usersFilePath := path.Join(t.TempDir(), "users.yaml")
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte(`
+users:
+  - name: ci
+    password: mypass
+    permissions: [tcpip-forward, direct-tcpip]
+  - name: admin
+    password: mypass
+  - name: nobody
+    password: mypass
+    permissions: []
+`), 0600))
+
+	// All permissions are allowed by default
+	address := startUsersFileServer(t, usersFilePath)
+	ciClient, err := dialWithPassword(address, "ci", "mypass")
+	assert.NoError(t, err)
+	defer ciClient.Close()
+	assertNoExec(t, ciClient)
+	assertNoSftp(t, ciClient)
+	assertLocalPortForwarding(t, ciClient)
+	assertRemotePortForwarding(t, ciClient)
+	assertNoUnixLocalPortForwarding(t, ciClient)
+
+	adminClient, err := dialWithPassword(address, "admin", "mypass")
+	assert.NoError(t, err)
+	defer adminClient.Close()
+	assertExec(t, adminClient)
+	assertSftp(t, adminClient)
+	assertLocalPortForwarding(t, adminClient)
+
+	nobodyClient, err := dialWithPassword(address, "nobody", "mypass")
+	assert.NoError(t, err)
+	defer nobodyClient.Close()
+	assertNoExec(t, nobodyClient)
+	assertNoLocalPortForwarding(t, nobodyClient)
+	assertNoRemotePortForwarding(t, nobodyClient)
+
+	// Users without permissions follow the flags
+	address = startUsersFileServer(t, usersFilePath, "--allow-execute")
+	adminClient, err = dialWithPassword(address, "admin", "mypass")
+	assert.NoError(t, err)
+	defer adminClient.Close()
+	assertExec(t, adminClient)
+	assertNoLocalPortForwarding(t, adminClient)
+	ciClient, err = dialWithPassword(address, "ci", "mypass")
+	assert.NoError(t, err)
+	defer ciClient.Close()
+	assertNoExec(t, ciClient)
+	assertLocalPortForwarding(t, ciClient)
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUsersFileSighup(t *testing.T) {
+	usersFilePath := path.Join(t.TempDir(), "users.yaml")
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte("users: [{name: john, password: mypass1}]"), 0600))
+	stat, err := os.Stat(usersFilePath)
+	assert.NoError(t, err)
+	address := startUsersFileServer(t, usersFilePath)
+	client, err := dialWithPassword(address, "john", "mypass1")
+	assert.NoError(t, err)
+	client.Close()
+
+	// Polling does not detect the modification because the size and modification time are not changed
+	assert.NoError(t, os.WriteFile(usersFilePath, []byte("users: [{name: john, password: mypass2}]"), 0600))
+	assert.NoError(t, os.Chtimes(usersFilePath, stat.ModTime(), stat.ModTime()))
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Eventually(t, func() bool {
+		client, err := dialWithPassword(address, "john", "mypass2")
+		if err != nil {
+			return false
+		}
+		client.Close()
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+}
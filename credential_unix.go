@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package handy_sshd
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setCredential makes the command run as the user. Without root, only the current user is allowed.
+func setCredential(cmd *exec.Cmd, runAs *runAsUser) error {
+	if runAs == nil {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		if uint32(os.Geteuid()) == runAs.uid {
+			return nil
+		}
+		return errors.Errorf("running as %s requires root", runAs.name)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: runAs.uid, Gid: runAs.gid, Groups: runAs.groups}
+	return nil
+}
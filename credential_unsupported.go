@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package handy_sshd
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func setCredential(cmd *exec.Cmd, runAs *runAsUser) error {
+	if runAs == nil {
+		return nil
+	}
+	return fmt.Errorf("running as %s unsupported", runAs.name)
+}
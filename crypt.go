@@ -0,0 +1,252 @@
+package handy_sshd
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"github.com/pkg/errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Implementation of SHA-crypt ($5$ and $6$) and MD5-crypt ($1$) used in /etc/shadow
+// (ref: https://www.akkadia.org/drepper/SHA-crypt.txt)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSaltLength = 16
+)
+
+type shaCryptAlgorithm struct {
+	prefix  string
+	newHash func() hash.Hash
+	// Byte order of the encoded hash in groups of 3 bytes
+	order [][3]int
+}
+
+var sha256Crypt = &shaCryptAlgorithm{
+	prefix:  "$5$",
+	newHash: sha256.New,
+	order: [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+		{-1, 31, 30},
+	},
+}
+
+var sha512Crypt = &shaCryptAlgorithm{
+	prefix:  "$6$",
+	newHash: sha512.New,
+	order: [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41}, {-1, -1, 63},
+	},
+}
+
+// crypt hashes the password with the setting (e.g. "$6$rounds=10000$salt" or a whole hash, whose hash part is ignored)
+func (a *shaCryptAlgorithm) crypt(password []byte, setting string) (string, error) {
+	if !strings.HasPrefix(setting, a.prefix) {
+		return "", errors.Errorf("not %s hash", a.prefix)
+	}
+	rest := setting[len(a.prefix):]
+	rounds := shaCryptDefaultRounds
+	roundsSpecified := false
+	if r, ok := strings.CutPrefix(rest, "rounds="); ok {
+		roundsString, afterRounds, found := strings.Cut(r, "$")
+		if !found {
+			return "", errors.New("invalid rounds")
+		}
+		n, err := strconv.ParseUint(roundsString, 10, 32)
+		if err != nil {
+			return "", errors.Errorf("invalid rounds: %s", roundsString)
+		}
+		// Out-of-range rounds are clamped as glibc does
+		rounds = int(n)
+		if rounds < shaCryptMinRounds {
+			rounds = shaCryptMinRounds
+		}
+		if rounds > shaCryptMaxRounds {
+			rounds = shaCryptMaxRounds
+		}
+		roundsSpecified = true
+		rest = afterRounds
+	}
+	salt, _, _ := strings.Cut(rest, "$")
+	if len(salt) > shaCryptMaxSaltLength {
+		salt = salt[:shaCryptMaxSaltLength]
+	}
+
+	h := a.newHash()
+	h.Write(password)
+	h.Write([]byte(salt))
+	h.Write(password)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write([]byte(salt))
+	h.Write(repeatBytes(b, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	digest := h.Sum(nil)
+
+	h.Reset()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	p := repeatBytes(h.Sum(nil), len(password))
+
+	h.Reset()
+	for i := 0; i < 16+int(digest[0]); i++ {
+		h.Write([]byte(salt))
+	}
+	s := repeatBytes(h.Sum(nil), len(salt))
+
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i%2 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(digest)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i%2 != 0 {
+			h.Write(digest)
+		} else {
+			h.Write(p)
+		}
+		digest = h.Sum(digest[:0])
+	}
+
+	var result strings.Builder
+	result.WriteString(a.prefix)
+	if roundsSpecified {
+		result.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	result.WriteString(salt)
+	result.WriteString("$")
+	result.WriteString(encodeCryptDigest(digest, a.order))
+	return result.String(), nil
+}
+
+const (
+	md5CryptPrefix        = "$1$"
+	md5CryptRounds        = 1000
+	md5CryptMaxSaltLength = 8
+)
+
+var md5CryptOrder = [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}, {-1, -1, 11}}
+
+// md5Crypt hashes the password with the setting (e.g. "$1$salt" or a whole hash) in the MD5-based crypt of FreeBSD
+// (ref: https://github.com/freebsd/freebsd-src/blob/main/lib/libcrypt/crypt-md5.c)
+func md5Crypt(password []byte, setting string) (string, error) {
+	if !strings.HasPrefix(setting, md5CryptPrefix) {
+		return "", errors.Errorf("not %s hash", md5CryptPrefix)
+	}
+	salt, _, _ := strings.Cut(setting[len(md5CryptPrefix):], "$")
+	if len(salt) > md5CryptMaxSaltLength {
+		salt = salt[:md5CryptMaxSaltLength]
+	}
+
+	h := md5.New()
+	h.Write(password)
+	h.Write([]byte(salt))
+	h.Write(password)
+	alternate := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write([]byte(md5CryptPrefix))
+	h.Write([]byte(salt))
+	h.Write(repeatBytes(alternate, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(password[:1])
+		}
+	}
+	digest := h.Sum(nil)
+
+	for i := 0; i < md5CryptRounds; i++ {
+		h.Reset()
+		if i%2 != 0 {
+			h.Write(password)
+		} else {
+			h.Write(digest)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(password)
+		}
+		if i%2 != 0 {
+			h.Write(digest)
+		} else {
+			h.Write(password)
+		}
+		digest = h.Sum(digest[:0])
+	}
+	return md5CryptPrefix + salt + "$" + encodeCryptDigest(digest, md5CryptOrder), nil
+}
+
+// repeatBytes repeats b up to the length
+func repeatBytes(b []byte, length int) []byte {
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		n := length - len(result)
+		if n > len(b) {
+			n = len(b)
+		}
+		result = append(result, b[:n]...)
+	}
+	return result
+}
+
+// encodeCryptDigest encodes the digest in groups of 3 bytes in the order (-1 means no byte)
+func encodeCryptDigest(digest []byte, order [][3]int) string {
+	var result strings.Builder
+	for _, group := range order {
+		var w uint32
+		n := 4
+		for _, index := range group {
+			w <<= 8
+			if index < 0 {
+				n--
+				continue
+			}
+			w |= uint32(digest[index])
+		}
+		result.WriteString(encodeCrypt64(w, n))
+	}
+	return result.String()
+}
+
+// encodeCrypt64 encodes the lower bits of w to n characters from the least significant 6 bits
+func encodeCrypt64(w uint32, n int) string {
+	var b []byte
+	for i := 0; i < n; i++ {
+		b = append(b, cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+	return string(b)
+}
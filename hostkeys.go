@@ -0,0 +1,113 @@
+package handy_sshd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH host key rotation extension
+// (ref: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL section 2.5)
+const (
+	hostKeysRequestType      = "hostkeys-00@openssh.com"
+	hostKeysProveRequestType = "hostkeys-prove-00@openssh.com"
+)
+
+// Key of ssh.Permissions.Extensions: host key algorithm negotiated in the key exchange (e.g. "rsa-sha2-256").
+// RSA host keys are proven with its signature algorithm as OpenSSH clients verify them with it.
+const ExtensionHostKeyAlgorithm = "host-key-algorithm@handy-sshd"
+
+// sendHostKeys announces all host keys so that clients with "UpdateHostKeys yes" learn them
+func (s *Server) sendHostKeys(sshConn *ssh.ServerConn) {
+	if len(s.HostKeys) == 0 {
+		return
+	}
+	var payload []byte
+	for _, hostKey := range s.HostKeys {
+		payload = appendString(payload, hostKey.PublicKey().Marshal())
+	}
+	if _, _, err := sshConn.SendRequest(hostKeysRequestType, false, payload); err != nil {
+		s.Logger.Info("failed to send host keys", "err", err)
+	}
+}
+
+// handleHostKeysProve replies signatures proving possession of the requested host keys
+func (s *Server) handleHostKeysProve(sshConn *ssh.ServerConn, req *ssh.Request) {
+	hostKeyBlobs, err := parseStrings(req.Payload)
+	if err != nil || len(hostKeyBlobs) == 0 {
+		s.Logger.Info("invalid hostkeys-prove request", "err", err)
+		req.Reply(false, nil)
+		return
+	}
+	var hostKeyAlgorithm string
+	if sshConn.Permissions != nil {
+		hostKeyAlgorithm = sshConn.Permissions.Extensions[ExtensionHostKeyAlgorithm]
+	}
+	var response []byte
+	for _, hostKeyBlob := range hostKeyBlobs {
+		signature, err := s.proveHostKey(sshConn.SessionID(), hostKeyBlob, hostKeyAlgorithm)
+		if err != nil {
+			s.Logger.Info("failed to prove host key", "err", err)
+			req.Reply(false, nil)
+			return
+		}
+		response = appendString(response, ssh.Marshal(signature))
+	}
+	req.Reply(true, response)
+}
+
+func (s *Server) proveHostKey(sessionID []byte, hostKeyBlob []byte, hostKeyAlgorithm string) (*ssh.Signature, error) {
+	for _, hostKey := range s.HostKeys {
+		if !bytes.Equal(hostKey.PublicKey().Marshal(), hostKeyBlob) {
+			continue
+		}
+		var data []byte
+		data = appendString(data, []byte(hostKeysProveRequestType))
+		data = appendString(data, sessionID)
+		data = appendString(data, hostKeyBlob)
+		if algorithmSigner, ok := hostKey.(ssh.AlgorithmSigner); ok && hostKey.PublicKey().Type() == ssh.KeyAlgoRSA {
+			return algorithmSigner.SignWithAlgorithm(rand.Reader, data, rsaProofAlgorithm(hostKeyAlgorithm))
+		}
+		return hostKey.Sign(rand.Reader, data)
+	}
+	return nil, errors.New("unknown host key requested")
+}
+
+// rsaProofAlgorithm returns the RSA signature algorithm of the negotiated host key algorithm like OpenSSH servers.
+// rsa-sha2-512 is used when a non-RSA host key was negotiated.
+func rsaProofAlgorithm(hostKeyAlgorithm string) string {
+	switch hostKeyAlgorithm {
+	case ssh.KeyAlgoRSASHA256, ssh.CertAlgoRSASHA256v01:
+		return ssh.KeyAlgoRSASHA256
+	case ssh.KeyAlgoRSA, ssh.CertAlgoRSAv01:
+		return ssh.KeyAlgoRSA
+	default:
+		return ssh.KeyAlgoRSASHA512
+	}
+}
+
+// appendString appends s in SSH string encoding (uint32 length followed by the bytes)
+func appendString(b []byte, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// parseStrings parses consecutive SSH strings
+func parseStrings(b []byte) ([][]byte, error) {
+	var strings [][]byte
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("truncated string length")
+		}
+		length := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint32(len(b)) < length {
+			return nil, errors.New("truncated string")
+		}
+		strings = append(strings, b[:length])
+		b = b[length:]
+	}
+	return strings, nil
+}
@@ -0,0 +1,105 @@
+package handy_sshd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"strings"
+)
+
+// Key types of GeneratePrivateKey()
+const (
+	KeyTypeEd25519 = "ed25519"
+	KeyTypeEcdsa   = "ecdsa"
+	KeyTypeRsa     = "rsa"
+)
+
+var KeyTypes = []string{KeyTypeEd25519, KeyTypeEcdsa, KeyTypeRsa}
+
+const DefaultRsaBits = 3072
+
+// GenerateKey generates a 2048-bit RSA private key in PKCS#1 PEM format.
+//
+// Deprecated: Use GeneratePrivateKey() or GenerateKeyPair() for other key types and sizes.
+func GenerateKey() ([]byte, error) {
+	var r io.Reader
+	r = rand.Reader
+	priv, err := rsa.GenerateKey(r, 2048)
+	if err != nil {
+		return nil, err
+	}
+	err = priv.Validate()
+	if err != nil {
+		return nil, err
+	}
+	b := x509.MarshalPKCS1PrivateKey(priv)
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: b}), nil
+}
+
+// GeneratePrivateKey generates a private key of the key type.
+// bits is the curve size for ECDSA (256, 384 or 521) and the key size for RSA (2048 or more). 0 means the default size. bits is ignored for Ed25519.
+func GeneratePrivateKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeEd25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	case KeyTypeEcdsa:
+		var curve elliptic.Curve
+		switch bits {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("invalid ECDSA key size: %d (256, 384 or 521)", bits)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case KeyTypeRsa:
+		if bits == 0 {
+			bits = DefaultRsaBits
+		}
+		if bits < 2048 || bits > 16384 {
+			return nil, errors.Errorf("invalid RSA key size: %d (2048 to 16384)", bits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	default:
+		return nil, errors.Errorf("unsupported key type: %s (%s)", keyType, strings.Join(KeyTypes, ", "))
+	}
+}
+
+// GenerateKeyPair generates a private key in OpenSSH private key format and its public key in authorized_keys format.
+// See GeneratePrivateKey() for keyType and bits.
+func GenerateKeyPair(keyType string, bits int, comment string) (privateKeyPem []byte, authorizedKey []byte, err error) {
+	privateKey, err := GeneratePrivateKey(keyType, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	pemBlock, err := ssh.MarshalPrivateKey(privateKey, comment)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(pemBlock), MarshalAuthorizedKeyWithComment(publicKey, comment), nil
+}
+
+// MarshalAuthorizedKeyWithComment is the same as ssh.MarshalAuthorizedKey() but appends the comment if not empty
+func MarshalAuthorizedKeyWithComment(publicKey ssh.PublicKey, comment string) []byte {
+	authorizedKey := ssh.MarshalAuthorizedKey(publicKey)
+	if comment == "" {
+		return authorizedKey
+	}
+	return append(authorizedKey[:len(authorizedKey)-1], []byte(" "+comment+"\n")...)
+}
@@ -0,0 +1,208 @@
+package handy_sshd
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strconv"
+	"strings"
+)
+
+// Algorithms of HashPassword()
+const (
+	PasswordHashBcrypt      = "bcrypt"
+	PasswordHashArgon2id    = "argon2id"
+	PasswordHashSha512Crypt = "sha512-crypt"
+)
+
+var PasswordHashAlgorithms = []string{PasswordHashBcrypt, PasswordHashArgon2id, PasswordHashSha512Crypt}
+
+// Parameters of argon2id hashes generated by HashPassword() (the second recommended option in RFC 9106)
+const (
+	argon2idTime      = 3
+	argon2idMemory    = 64 * 1024
+	argon2idThreads   = 4
+	argon2idKeyLength = 32
+	argon2idSaltSize  = 16
+)
+
+// HashPassword hashes the password in the format of the algorithm:
+// bcrypt ("$2a$..."), argon2id in PHC string format ("$argon2id$v=19$...") or sha512-crypt ("$6$...")
+func HashPassword(algorithm string, password []byte) (string, error) {
+	switch algorithm {
+	case PasswordHashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+		return string(hash), err
+	case PasswordHashArgon2id:
+		salt := make([]byte, argon2idSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey(password, salt, argon2idTime, argon2idMemory, argon2idThreads, argon2idKeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2idMemory, argon2idTime, argon2idThreads, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	case PasswordHashSha512Crypt:
+		salt := make([]byte, shaCryptMaxSaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		for i := range salt {
+			salt[i] = cryptAlphabet[int(salt[i])%len(cryptAlphabet)]
+		}
+		return sha512Crypt.crypt(password, sha512Crypt.prefix+string(salt))
+	default:
+		return "", errors.Errorf("unsupported password hash algorithm: %s (%s)", algorithm, strings.Join(PasswordHashAlgorithms, ", "))
+	}
+}
+
+// IsPasswordHash returns true if s looks like a hash supported by VerifyPassword()
+func IsPasswordHash(s string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return findCryptHash(s) != nil
+}
+
+// ValidatePasswordHash returns an error if the hash is malformed
+func ValidatePasswordHash(hash string) error {
+	_, err := verifyPassword(hash, nil, false)
+	return err
+}
+
+// VerifyPassword returns true if the password matches the hash. The comparison is constant time.
+func VerifyPassword(hash string, password []byte) bool {
+	ok, err := verifyPassword(hash, password, true)
+	return err == nil && ok
+}
+
+// verifyPassword only validates the hash when verify is false
+func verifyPassword(hash string, password []byte, verify bool) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return false, errors.Wrap(err, "invalid bcrypt hash")
+		}
+		if !verify {
+			return false, nil
+		}
+		// "$2y$" is the same as "$2b$" (PHP's crypt())
+		if strings.HasPrefix(hash, "$2y$") {
+			hash = "$2b$" + hash[len("$2y$"):]
+		}
+		return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password, verify)
+	case findCryptHash(hash) != nil:
+		cryptHash := findCryptHash(hash)
+		parts := strings.Split(hash, "$")
+		if len(parts) < 4 {
+			return false, errors.Errorf("invalid %s hash", cryptHash.name)
+		}
+		if cryptHash.prefix == yescryptPrefix {
+			// "$y$<params>$<salt>$<hash>"
+			if len(parts) != 5 {
+				return false, errors.Errorf("invalid %s hash", cryptHash.name)
+			}
+			if _, err := parseYescryptParams(parts[2]); err != nil {
+				return false, errors.Wrapf(err, "invalid %s hash", cryptHash.name)
+			}
+			if _, err := decodeYescrypt64(parts[3]); err != nil {
+				return false, errors.Wrapf(err, "invalid %s hash", cryptHash.name)
+			}
+		}
+		// Not computed only to validate because crypt is slow (e.g. for all accounts in /etc/shadow)
+		if !verify {
+			return false, validateCryptHash(cryptHash, parts)
+		}
+		computed, err := cryptHash.crypt(password, hash)
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid %s hash", cryptHash.name)
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+	default:
+		return false, errors.New("unsupported password hash")
+	}
+}
+
+type cryptHash struct {
+	prefix string
+	name   string
+	crypt  func(password []byte, setting string) (string, error)
+	// Length of the encoded hash after the last "$"
+	encodedLength int
+}
+
+// Hashes of crypt(3) used in /etc/shadow
+var cryptHashes = []cryptHash{
+	{prefix: md5CryptPrefix, name: "md5-crypt", crypt: md5Crypt, encodedLength: 22},
+	{prefix: sha256Crypt.prefix, name: "sha256-crypt", crypt: sha256Crypt.crypt, encodedLength: 43},
+	{prefix: sha512Crypt.prefix, name: "sha512-crypt", crypt: sha512Crypt.crypt, encodedLength: 86},
+	{prefix: yescryptPrefix, name: "yescrypt", crypt: yescrypt, encodedLength: 43},
+}
+
+func findCryptHash(hash string) *cryptHash {
+	for i := range cryptHashes {
+		if strings.HasPrefix(hash, cryptHashes[i].prefix) {
+			return &cryptHashes[i]
+		}
+	}
+	return nil
+}
+
+// validateCryptHash validates the syntax of the hash split by "$" without computing it
+func validateCryptHash(cryptHash *cryptHash, parts []string) error {
+	encoded := parts[len(parts)-1]
+	if len(encoded) != cryptHash.encodedLength || strings.Trim(encoded, cryptAlphabet) != "" {
+		return errors.Errorf("invalid %s hash", cryptHash.name)
+	}
+	if cryptHash.prefix == yescryptPrefix {
+		return nil
+	}
+	// "$<id>$[rounds=<rounds>$]<salt>$<hash>" (md5-crypt has no rounds)
+	settings := parts[2 : len(parts)-1]
+	if rounds, ok := strings.CutPrefix(settings[0], "rounds="); ok && cryptHash.prefix != md5CryptPrefix && len(settings) == 2 {
+		if _, err := strconv.ParseUint(rounds, 10, 32); err != nil {
+			return errors.Errorf("invalid %s rounds: %s", cryptHash.name, rounds)
+		}
+		settings = settings[1:]
+	}
+	if len(settings) != 1 {
+		return errors.Errorf("invalid %s hash", cryptHash.name)
+	}
+	return nil
+}
+
+// verifyArgon2id verifies the password with an argon2id hash in PHC string format (e.g. "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>")
+func verifyArgon2id(hash string, password []byte, verify bool) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errors.New("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.Errorf("unsupported argon2id version: %s", parts[2])
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time == 0 || threads == 0 {
+		return false, errors.Errorf("invalid argon2id parameters: %s", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errors.Wrap(err, "invalid argon2id salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, errors.New("invalid argon2id hash")
+	}
+	if !verify {
+		return false, nil
+	}
+	computed := argon2.IDKey(password, salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
@@ -0,0 +1,287 @@
+package handy_sshd
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Critical options and extensions in ssh.Permissions which Server honors.
+// Authentication callbacks can restrict an authenticated client by returning them.
+// Absent extensions mean no restriction.
+const (
+	// Command executed instead of the command requested by the client (the same as OpenSSH certificates)
+	CriticalOptionForceCommand = "force-command"
+	// Comma-separated addresses in CIDR format which the client has to connect from (the same as OpenSSH certificates)
+	CriticalOptionSourceAddress = "source-address"
+
+	// pty-req is not allowed
+	ExtensionNoPty = "no-pty@handy-sshd"
+	// Port forwarding (TCP and Unix domain socket) is not allowed
+	ExtensionNoPortForwarding = "no-port-forwarding@handy-sshd"
+	// Newline-separated "host:port" which local forwarding can connect to ("*" matches any host or port)
+	ExtensionPermitOpen = "permitopen@handy-sshd"
+	// Newline-separated "host:port" which remote forwarding can listen on ("*" matches any host or port)
+	ExtensionPermitListen = "permitlisten@handy-sshd"
+	// Newline-separated "NAME=value" passed to executed commands
+	ExtensionEnvironment = "environment@handy-sshd"
+	// RFC 3339 time after which new channels and forwarding requests are rejected
+	ExtensionExpiryTime = "expiry-time@handy-sshd"
+	// Comma-separated permission names (e.g. "direct-tcpip,tcpip-forward") which replace the Allow* fields of Server for the client
+	ExtensionPermissions = "permissions@handy-sshd"
+	// Login shell replacing the shell of Server.HandleChannels() (e.g. the shell in /etc/passwd)
+	ExtensionShell = "shell@handy-sshd"
+	// Working directory and $HOME of executed commands
+	ExtensionHomeDirectory = "home-directory@handy-sshd"
+	// OS user name whose uid, gid, supplementary groups and home directory executed commands and SFTP run with. Running as another user requires root.
+	ExtensionUser = "user@handy-sshd"
+)
+
+// Permission names in ExtensionPermissions
+const (
+	PermissionTcpipForward       = "tcpip-forward"
+	PermissionDirectTcpip        = "direct-tcpip"
+	PermissionExecute            = "execute"
+	PermissionSftp               = "sftp"
+	PermissionStreamlocalForward = "streamlocal-forward"
+	PermissionDirectStreamlocal  = "direct-streamlocal"
+)
+
+var PermissionNames = []string{PermissionTcpipForward, PermissionDirectTcpip, PermissionExecute, PermissionSftp, PermissionStreamlocalForward, PermissionDirectStreamlocal}
+
+// permissions is what an authenticated client can do
+type permissions struct {
+	allowTcpipForward       bool
+	allowDirectTcpip        bool
+	allowExecute            bool
+	allowPty                bool
+	allowSftp               bool
+	allowStreamlocalForward bool
+	allowDirectStreamlocal  bool
+
+	forceCommand string
+	permitOpen   []string
+	permitListen []string
+	environment  []string
+	expiryTime   time.Time
+	// Empty means the shell of Server.HandleChannels()
+	shell string
+	// Empty means the working directory and $HOME of this process
+	homeDirectory string
+	// nil means this process's user
+	runAs *runAsUser
+}
+
+func (s *Server) permissionsOf(sshConn *ssh.ServerConn) *permissions {
+	p := &permissions{
+		allowTcpipForward:       s.AllowTcpipForward,
+		allowDirectTcpip:        s.AllowDirectTcpip,
+		allowExecute:            s.AllowExecute,
+		allowPty:                s.AllowExecute,
+		allowSftp:               s.AllowSftp,
+		allowStreamlocalForward: s.AllowStreamlocalForward,
+		allowDirectStreamlocal:  s.AllowDirectStreamlocal,
+	}
+	if sshConn.Permissions == nil {
+		return p
+	}
+	if sourceAddress, ok := sshConn.Permissions.CriticalOptions[CriticalOptionSourceAddress]; ok {
+		if err := checkSourceAddress(sshConn.RemoteAddr(), sourceAddress); err != nil {
+			s.Logger.Info("nothing allowed", "err", err)
+			return &permissions{}
+		}
+	}
+	p.forceCommand = sshConn.Permissions.CriticalOptions[CriticalOptionForceCommand]
+	extensions := sshConn.Permissions.Extensions
+	if permissionNames, ok := extensions[ExtensionPermissions]; ok {
+		p.setAllowed(permissionNames)
+	}
+	if _, ok := extensions[ExtensionNoPty]; ok {
+		p.allowPty = false
+	}
+	if _, ok := extensions[ExtensionNoPortForwarding]; ok {
+		p.allowTcpipForward = false
+		p.allowDirectTcpip = false
+		p.allowStreamlocalForward = false
+		p.allowDirectStreamlocal = false
+	}
+	if permitOpen, ok := extensions[ExtensionPermitOpen]; ok {
+		p.permitOpen = strings.Split(permitOpen, "\n")
+	}
+	if permitListen, ok := extensions[ExtensionPermitListen]; ok {
+		p.permitListen = strings.Split(permitListen, "\n")
+	}
+	if environment, ok := extensions[ExtensionEnvironment]; ok {
+		p.environment = strings.Split(environment, "\n")
+	}
+	p.shell = extensions[ExtensionShell]
+	p.homeDirectory = extensions[ExtensionHomeDirectory]
+	if name, ok := extensions[ExtensionUser]; ok {
+		runAs, err := lookupRunAsUser(name)
+		if err != nil {
+			s.Logger.Error("nothing allowed because the user is not found", "user", name, "err", err)
+			// fail closed
+			return &permissions{}
+		}
+		p.runAs = runAs
+		if p.homeDirectory == "" {
+			p.homeDirectory = runAs.homeDirectory
+		}
+	}
+	if expiryTime, ok := extensions[ExtensionExpiryTime]; ok {
+		t, err := time.Parse(time.RFC3339, expiryTime)
+		if err != nil {
+			s.Logger.Error("invalid expiry time", "expiry_time", expiryTime, "err", err)
+			// fail closed
+			t = time.Unix(0, 0)
+		}
+		p.expiryTime = t
+	}
+	return p
+}
+
+// checkSourceAddress checks the remote address with comma-separated addresses in CIDR format
+func checkSourceAddress(remoteAddr net.Addr, sourceAddress string) error {
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return errors.Errorf("remote address %v is not a TCP address", remoteAddr)
+	}
+	for _, address := range strings.Split(sourceAddress, ",") {
+		if ip := net.ParseIP(address); ip != nil {
+			if ip.Equal(tcpAddr.IP) {
+				return nil
+			}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(address)
+		if err != nil {
+			return errors.Errorf("invalid source-address: %s", address)
+		}
+		if ipNet.Contains(tcpAddr.IP) {
+			return nil
+		}
+	}
+	return errors.Errorf("remote address %v is not allowed by source-address %q", remoteAddr, sourceAddress)
+}
+
+// setAllowed allows only the comma-separated permissions
+func (p *permissions) setAllowed(permissionNames string) {
+	p.allowTcpipForward = false
+	p.allowDirectTcpip = false
+	p.allowExecute = false
+	p.allowPty = false
+	p.allowSftp = false
+	p.allowStreamlocalForward = false
+	p.allowDirectStreamlocal = false
+	for _, name := range strings.Split(permissionNames, ",") {
+		switch strings.TrimSpace(name) {
+		case PermissionTcpipForward:
+			p.allowTcpipForward = true
+		case PermissionDirectTcpip:
+			p.allowDirectTcpip = true
+		case PermissionExecute:
+			p.allowExecute = true
+			p.allowPty = true
+		case PermissionSftp:
+			p.allowSftp = true
+		case PermissionStreamlocalForward:
+			p.allowStreamlocalForward = true
+		case PermissionDirectStreamlocal:
+			p.allowDirectStreamlocal = true
+		}
+	}
+}
+
+// workingDirectory returns the home directory or "/" when it does not exist in the same way as OpenSSH. Empty means the working directory of this process.
+func (p *permissions) workingDirectory() string {
+	if p.homeDirectory == "" {
+		return ""
+	}
+	if stat, err := os.Stat(p.homeDirectory); err != nil || !stat.IsDir() {
+		return "/"
+	}
+	return p.homeDirectory
+}
+
+func (p *permissions) expired() bool {
+	return !p.expiryTime.IsZero() && time.Now().After(p.expiryTime)
+}
+
+// commandEnv returns environment variables of executed commands. nil means the environment of this process.
+func (p *permissions) commandEnv(originalCommand string) []string {
+	if len(p.environment) == 0 && originalCommand == "" && p.shell == "" && p.homeDirectory == "" && p.runAs == nil {
+		return nil
+	}
+	var env []string
+	if p.runAs == nil {
+		env = os.Environ()
+	} else {
+		env = p.runAs.loginEnv()
+	}
+	if p.homeDirectory != "" {
+		env = append(env, "HOME="+p.homeDirectory)
+	}
+	if p.shell != "" {
+		env = append(env, "SHELL="+p.shell)
+	}
+	env = append(env, p.environment...)
+	if originalCommand != "" {
+		env = append(env, "SSH_ORIGINAL_COMMAND="+originalCommand)
+	}
+	return env
+}
+
+func (p *permissions) permitsOpen(host string, port uint32) bool {
+	return p.permitOpen == nil || matchHostPorts(p.permitOpen, host, port)
+}
+
+func (p *permissions) permitsListen(host string, port uint32) bool {
+	return p.permitListen == nil || matchHostPorts(p.permitListen, host, port)
+}
+
+// matchHostPorts returns true if one of "host:port" patterns matches. Host can be a wildcard pattern (e.g. "*.example.com") and port can be "*".
+func matchHostPorts(hostPorts []string, host string, port uint32) bool {
+	for _, hostPort := range hostPorts {
+		patternHost, patternPort, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			continue
+		}
+		if patternPort != "*" && patternPort != strconv.Itoa(int(port)) {
+			continue
+		}
+		if matchPattern(strings.ToLower(patternHost), strings.ToLower(host)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern matches s with the pattern, which can contain "*" (any characters) and "?" (one character)
+func matchPattern(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package handy_sshd
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes the command run in its own process group so that the group can be signaled
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// hangupProcessGroup sends SIGHUP to the process group led by the command
+func hangupProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGHUP)
+}
+
+// killProcessGroup sends SIGKILL to the process group led by the command
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
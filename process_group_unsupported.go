@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package handy_sshd
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// hangupProcessGroup does nothing because there are no signals to ask the process to exit
+func hangupProcessGroup(cmd *exec.Cmd) error {
+	return nil
+}
+
+// killProcessGroup kills only the process
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
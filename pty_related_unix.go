@@ -12,54 +12,70 @@ import (
 	"io"
 	"os"
 	"os/exec"
-	"sync"
+	"syscall"
 )
 
-func (s *Server) createPty(shell string, connection ssh.Channel) (*os.File, error) {
-	if shell == "" {
-		shell = os.Getenv("SHELL")
-	}
-	if shell == "" {
-		shell = "sh"
-	}
-	// Fire up bash for this session
-	sh := exec.Command(shell)
-
-	// Prepare teardown function
-	closer := func() {
-		connection.SendRequest("exit-status", false, ssh.Marshal(exitStatusMsg{
-			Status: 0,
-		}))
-		connection.Close()
-		if sh.Process != nil {
-			_, err := sh.Process.Wait()
-			if err != nil {
-				s.Logger.Info("failed to exit shell", err)
-			}
+// startPty starts the command attached to a new pty of the requested size. The exit status is sent when the command exits.
+// The command leads a new session and a process group of the pty.
+func (s *Server) startPty(cmd *exec.Cmd, connection ssh.Channel, ptyReq *ptyRequest) (*sessionProcess, error) {
+	if ptyReq.Term != "" {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
 		}
-		s.Logger.Info("session closed")
+		cmd.Env = append(cmd.Env, "TERM="+ptyReq.Term)
 	}
-
 	// Allocate a terminal for this channel
 	s.Logger.Info("creating pty...")
-	shf, err := pty.Start(sh)
+	shf, err := s.startWithTerminal(cmd, ptyReq)
 	if err != nil {
 		s.Logger.Info("failed to start pty", "err", err)
-		closer()
 		return nil, errors.Errorf("could not start pty (%s)", err)
 	}
 
+	process := &sessionProcess{cmd: cmd, pty: shf, exited: make(chan struct{})}
 	// pipe session to bash and visa-versa
-	var once sync.Once
 	go func() {
+		// Reading the pty fails after the command exits and all output is read
 		io.Copy(connection, shf)
-		once.Do(closer)
+		err := cmd.Wait()
+		close(process.exited)
+		shf.Close()
+		s.exit(connection, exitCodeOf(err))
+		s.Logger.Info("session closed")
 	}()
 	go func() {
+		// The session ends when the command exits, not when the input ends
 		io.Copy(shf, connection)
-		once.Do(closer)
 	}()
-	return shf, nil
+	return process, nil
+}
+
+// startWithTerminal starts the command on a new pty with the size and the terminal modes of the request in the same way as pty.StartWithSize()
+func (s *Server) startWithTerminal(cmd *exec.Cmd, ptyReq *ptyRequest) (*os.File, error) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+	if err := pty.Setsize(ptmx, &pty.Winsize{Rows: uint16(ptyReq.Rows), Cols: uint16(ptyReq.Columns)}); err != nil {
+		ptmx.Close()
+		return nil, err
+	}
+	// Applied before the command starts so that it sees the modes (e.g. "stty -echo" of the client)
+	if err := applyTerminalModes(tty, ptyReq.Modes); err != nil {
+		s.Logger.Info("failed to apply terminal modes", "err", err)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	if err := cmd.Start(); err != nil {
+		ptmx.Close()
+		return nil, err
+	}
+	return ptmx, nil
 }
 
 // setWinsize sets the size of the given pty.
@@ -7,9 +7,10 @@ import (
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"os"
+	"os/exec"
 )
 
-func (s *Server) createPty(shell string, connection ssh.Channel) (*os.File, error) {
+func (s *Server) startPty(cmd *exec.Cmd, connection ssh.Channel, ptyReq *ptyRequest) (*sessionProcess, error) {
 	return nil, fmt.Errorf("creation of pty unsupported")
 }
 
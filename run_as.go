@@ -0,0 +1,78 @@
+package handy_sshd
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// PATH of sessions running as other users like _PATH_STDPATH of OpenSSH
+const runAsPath = "/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin"
+
+// runAsUser is the OS user of ExtensionUser which sessions run as
+type runAsUser struct {
+	name          string
+	uid           uint32
+	gid           uint32
+	groups        []uint32
+	homeDirectory string
+	// Login shell in /etc/passwd. Empty when not found.
+	shell string
+}
+
+func lookupRunAsUser(name string) (*runAsUser, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, errors.Errorf("unsupported uid: %s", u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, errors.Errorf("unsupported gid: %s", u.Gid)
+	}
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get supplementary groups")
+	}
+	runAs := &runAsUser{name: u.Username, uid: uint32(uid), gid: uint32(gid), homeDirectory: u.HomeDir, shell: loginShell(u.Username)}
+	for _, groupId := range groupIds {
+		g, err := strconv.ParseUint(groupId, 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("unsupported gid: %s", groupId)
+		}
+		runAs.groups = append(runAs.groups, uint32(g))
+	}
+	return runAs, nil
+}
+
+// loginEnv returns the login environment of the user. The environment of this process (e.g. secrets of root) is not inherited.
+func (u *runAsUser) loginEnv() []string {
+	env := []string{"HOME=" + u.homeDirectory, "USER=" + u.name, "LOGNAME=" + u.name, "PATH=" + runAsPath}
+	if u.shell != "" {
+		env = append(env, "SHELL="+u.shell)
+	}
+	return env
+}
+
+// loginShell returns the login shell of the user in /etc/passwd
+func loginShell(name string) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == name {
+			return fields[6]
+		}
+	}
+	return ""
+}
@@ -8,28 +8,30 @@
 package handy_sshd
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
+	"bytes"
 	"encoding/binary"
-	"encoding/pem"
 	"fmt"
 	"github.com/mattn/go-shellwords"
 	"github.com/nwtgck/handy-sshd/sync_generics"
+	"github.com/pkg/errors"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/exp/slog"
 	"io"
+	"io/fs"
 	"net"
 	"os"
 	"os/exec"
 	"strconv"
 	"sync"
+	"time"
 )
 
 type Server struct {
 	Logger                *slog.Logger
 	bindAddressToListener sync_generics.Map[string, net.Listener]
+	// Host keys announced with hostkeys-00@openssh.com and proven with hostkeys-prove-00@openssh.com (certificates should not be included)
+	HostKeys []ssh.Signer
 
 	// Permissions
 	AllowTcpipForward       bool
@@ -39,6 +41,14 @@ type Server struct {
 	AllowStreamlocalForward bool
 	AllowDirectStreamlocal  bool
 
+	// Command serving SFTP on stdin and stdout with ServeSftp() (e.g. this executable with a subcommand).
+	// It runs as the user of ExtensionUser so that files are owned by the user. SFTP is not allowed with ExtensionUser without it.
+	SftpHelperCommand []string
+	// Message of the day written to the terminal of pty sessions before the shell starts. The file is read on every session.
+	MotdFile string
+	// Time from SIGHUP to SIGKILL sent to the process group of a session closed by the client
+	CloseGracePeriod time.Duration
+
 	// TODO: DNS server ?
 }
 
@@ -46,25 +56,30 @@ type exitStatusMsg struct {
 	Status uint32
 }
 
-func (s *Server) HandleChannels(shell string, chans <-chan ssh.NewChannel) {
+func (s *Server) HandleChannels(sshConn *ssh.ServerConn, shell string, chans <-chan ssh.NewChannel) {
+	perms := s.permissionsOf(sshConn)
 	// Service the incoming Channel channel in go routine
 	for newChannel := range chans {
-		go s.handleChannel(shell, newChannel)
+		go s.handleChannel(perms, shell, newChannel)
 	}
 }
 
-func (s *Server) handleChannel(shell string, newChannel ssh.NewChannel) {
+func (s *Server) handleChannel(perms *permissions, shell string, newChannel ssh.NewChannel) {
+	if perms.expired() {
+		newChannel.Reject(ssh.Prohibited, "permissions expired")
+		return
+	}
 	switch newChannel.ChannelType() {
 	case "session":
-		s.handleSession(shell, newChannel)
+		s.handleSession(perms, shell, newChannel)
 	case "direct-tcpip":
-		if !s.AllowDirectTcpip {
+		if !perms.allowDirectTcpip {
 			newChannel.Reject(ssh.Prohibited, "direct-tcpip not allowed")
 			break
 		}
-		s.handleDirectTcpip(newChannel)
+		s.handleDirectTcpip(perms, newChannel)
 	case "direct-streamlocal@openssh.com":
-		if !s.AllowDirectStreamlocal {
+		if !perms.allowDirectStreamlocal {
 			newChannel.Reject(ssh.Prohibited, "direct-streamlocal (Unix domain socket) not allowed")
 			break
 		}
@@ -74,7 +89,18 @@ func (s *Server) handleChannel(shell string, newChannel ssh.NewChannel) {
 	}
 }
 
-func (s *Server) handleSession(shell string, newChannel ssh.NewChannel) {
+// ptyRequest is "pty-req" kept until the process starts on "shell" or "exec"
+type ptyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	// Encoded terminal modes applied to the pty (e.g. ECHO and VINTR)
+	Modes string
+}
+
+func (s *Server) handleSession(perms *permissions, shell string, newChannel ssh.NewChannel) {
 	// At this point, we have the opportunity to reject the client's
 	// request for another logical connection
 	connection, requests, err := newChannel.Accept()
@@ -83,125 +109,398 @@ func (s *Server) handleSession(shell string, newChannel ssh.NewChannel) {
 		return
 	}
 
-	var shf *os.File = nil
+	var ptyReq *ptyRequest
+	var process *sessionProcess
+	// Only one process runs in a session
+	started := false
 
 	for req := range requests {
 		switch req.Type {
 		case "exec":
-			if !s.AllowExecute {
+			if !perms.allowExecute {
 				s.Logger.Info("execution not allowed (exec)")
 				req.Reply(false, nil)
 				break
 			}
-			s.handleExecRequest(req, connection)
+			if started {
+				req.Reply(false, nil)
+				break
+			}
+			started = true
+			if ptyReq == nil {
+				process = s.handleExecRequest(perms, req, connection)
+				break
+			}
+			process = s.handleExecRequestWithPty(perms, req, connection, ptyReq)
 		case "shell":
 			// We only accept the default shell
 			// (i.e. no command in the Payload)
-			if len(req.Payload) == 0 {
-				req.Reply(true, nil)
+			if len(req.Payload) != 0 || started {
+				req.Reply(false, nil)
+				break
 			}
-		case "pty-req":
-			if !s.AllowExecute {
-				s.Logger.Info("execution not allowed (pty-req)")
+			if !perms.allowExecute {
+				s.Logger.Info("execution not allowed (shell)")
 				req.Reply(false, nil)
 				break
 			}
-			termLen := req.Payload[3]
-			w, h := parseDims(req.Payload[termLen+4:])
-			shf, err = s.createPty(shell, connection)
+			started = true
+			sh, err := s.shellCommand(perms, shell)
 			if err != nil {
+				s.Logger.Info("failed to create shell command", "err", err)
 				req.Reply(false, nil)
-				return
+				break
+			}
+			if ptyReq == nil {
+				process = s.runWithPipes(sh, req, connection)
+				break
+			}
+			s.writeMotd(connection)
+			process, err = s.startPty(sh, connection, ptyReq)
+			if err != nil {
+				req.Reply(false, nil)
+				connection.Close()
+				break
 			}
-			setWinsize(shf, w, h)
 			// Responding true (OK) here will let the client
-			// know we have a pty ready for input
+			// know the shell is ready for input
+			req.Reply(true, nil)
+		case "pty-req":
+			if !perms.allowExecute {
+				s.Logger.Info("execution not allowed (pty-req)")
+				req.Reply(false, nil)
+				break
+			}
+			if !perms.allowPty {
+				s.Logger.Info("pty not allowed")
+				req.Reply(false, nil)
+				break
+			}
+			var msg ptyRequest
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil || started {
+				req.Reply(false, nil)
+				break
+			}
+			ptyReq = &msg
 			req.Reply(true, nil)
 		case "window-change":
 			w, h := parseDims(req.Payload)
-			if shf != nil {
-				setWinsize(shf, w, h)
+			if process != nil && process.pty != nil {
+				setWinsize(process.pty, w, h)
+			} else if ptyReq != nil {
+				ptyReq.Columns, ptyReq.Rows = w, h
 			}
 		case "subsystem":
-			s.handleSessionSubSystem(req, connection)
+			s.handleSessionSubSystem(perms, req, connection)
 		default:
 			s.Logger.Info("unsupported request", "req_type", req.Type)
 		}
 	}
+	// The channel is closed
+	if process != nil {
+		s.terminate(process)
+	}
 }
 
-func (s *Server) handleExecRequest(req *ssh.Request, connection ssh.Channel) {
-	var msg struct {
-		Command string
+// sessionProcess is the process started by "shell" or "exec"
+type sessionProcess struct {
+	cmd *exec.Cmd
+	// nil without a pty
+	pty *os.File
+	// closed when the process exited
+	exited chan struct{}
+}
+
+// terminate hangs up the process group of the session closed by the client and kills it after Server.CloseGracePeriod without blocking the caller
+func (s *Server) terminate(process *sessionProcess) {
+	select {
+	case <-process.exited:
+		return
+	default:
 	}
-	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
-		s.Logger.Info("failed to parse message in exec", "err", err)
+	s.Logger.Info("hanging up the process of the closed session", "pid", process.cmd.Process.Pid)
+	if err := hangupProcessGroup(process.cmd); err != nil {
+		s.Logger.Info("failed to hang up the process", "err", err)
+	}
+	go func() {
+		timer := time.NewTimer(s.CloseGracePeriod)
+		defer timer.Stop()
+		select {
+		case <-process.exited:
+		case <-timer.C:
+			s.Logger.Info("killing the process of the closed session", "pid", process.cmd.Process.Pid)
+			if err := killProcessGroup(process.cmd); err != nil {
+				s.Logger.Info("failed to kill the process", "err", err)
+			}
+		}
+	}()
+}
+
+// writeMotd writes the message of the day to the terminal. Newlines are converted to CRLF because the terminal of the client is in raw mode.
+func (s *Server) writeMotd(connection ssh.Channel) {
+	if s.MotdFile == "" {
 		return
 	}
-	cmdSlice, err := shellwords.Parse(msg.Command)
+	motd, err := os.ReadFile(s.MotdFile)
 	if err != nil {
+		s.Logger.Info("failed to read motd", "err", err)
 		return
 	}
+	motd = bytes.ReplaceAll(bytes.ReplaceAll(motd, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	connection.Write(motd)
+}
+
+// shellCommand returns the shell or the forced command
+func (s *Server) shellCommand(perms *permissions, shell string) (*exec.Cmd, error) {
+	if perms.forceCommand != "" {
+		return s.command(perms, perms.forceCommand, "")
+	}
+	if perms.shell != "" {
+		shell = perms.shell
+	}
+	if shell == "" {
+		shell = os.Getenv("SHELL")
+	}
+	if shell == "" {
+		shell = "sh"
+	}
+	sh := exec.Command(shell)
+	sh.Env = perms.commandEnv("")
+	sh.Dir = perms.workingDirectory()
+	if err := setCredential(sh, perms.runAs); err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+// command returns the command to be executed. originalCommand is the command requested by the client when the command is forced.
+func (s *Server) command(perms *permissions, command string, originalCommand string) (*exec.Cmd, error) {
+	cmdSlice, err := shellwords.Parse(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(cmdSlice) == 0 {
+		return nil, errors.Errorf("empty command")
+	}
 	cmd := exec.Command(cmdSlice[0], cmdSlice[1:]...)
+	cmd.Env = perms.commandEnv(originalCommand)
+	cmd.Dir = perms.workingDirectory()
+	if err := setCredential(cmd, perms.runAs); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// execCommand returns the command of "exec" or the forced command
+func (s *Server) execCommand(perms *permissions, req *ssh.Request) (*exec.Cmd, error) {
+	var msg struct {
+		Command string
+	}
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		return nil, errors.Wrap(err, "failed to parse message in exec")
+	}
+	if perms.forceCommand == "" {
+		return s.command(perms, msg.Command, "")
+	}
+	s.Logger.Info("forced command", "command", perms.forceCommand, "original_command", msg.Command)
+	return s.command(perms, perms.forceCommand, msg.Command)
+}
+
+// handleExecRequestWithPty starts the command attached to a pty
+func (s *Server) handleExecRequestWithPty(perms *permissions, req *ssh.Request, connection ssh.Channel, ptyReq *ptyRequest) *sessionProcess {
+	cmd, err := s.execCommand(perms, req)
+	if err != nil {
+		s.Logger.Info("failed to create command", "err", err)
+		req.Reply(false, nil)
+		return nil
+	}
+	process, err := s.startPty(cmd, connection, ptyReq)
+	if err != nil {
+		req.Reply(false, nil)
+		connection.Close()
+		return nil
+	}
+	req.Reply(true, nil)
+	return process
+}
+
+func (s *Server) handleExecRequest(perms *permissions, req *ssh.Request, connection ssh.Channel) *sessionProcess {
+	cmd, err := s.execCommand(perms, req)
+	if err != nil {
+		s.Logger.Info("failed to create command", "err", err)
+		req.Reply(false, nil)
+		return nil
+	}
+	return s.runWithPipes(cmd, req, connection)
+}
+
+// runWithPipes starts the command with stdin, stdout and stderr on pipes and sends the exit status when it exits
+func (s *Server) runWithPipes(cmd *exec.Cmd, req *ssh.Request, connection ssh.Channel) *sessionProcess {
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return
+		req.Reply(false, nil)
+		return nil
 	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return
+		req.Reply(false, nil)
+		return nil
 	}
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return
+		req.Reply(false, nil)
+		return nil
 	}
-	go io.Copy(stdin, connection)
-	go io.Copy(connection, stdout)
-	go io.Copy(connection, stderr)
+	// The process group is signaled when the session is closed
+	setProcessGroup(cmd)
+	var outputWaitGroup sync.WaitGroup
+	outputWaitGroup.Add(2)
+	go func() {
+		io.Copy(stdin, connection)
+		// The end of input is propagated (e.g. "echo data | ssh host wc -l")
+		stdin.Close()
+	}()
+	go func() {
+		io.Copy(connection, stdout)
+		outputWaitGroup.Done()
+	}()
+	go func() {
+		// Sent as extended data so that the client can tell stderr from stdout
+		io.Copy(connection.Stderr(), stderr)
+		outputWaitGroup.Done()
+	}()
 	req.Reply(true, nil)
-	var exitCode int
-	if err := cmd.Run(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.ExitCode()
-		}
-	}
+	if err := cmd.Start(); err != nil {
+		s.Logger.Info("failed to start command", "err", err)
+		// The request is already accepted, so the failure is reported like "command not found" of shells
+		fmt.Fprintln(connection.Stderr(), err)
+		s.exit(connection, startErrorExitCode(err))
+		return nil
+	}
+	process := &sessionProcess{cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		// NOTE: cmd.Wait() closes stdout and stderr, so it should be called after reading all output
+		outputWaitGroup.Wait()
+		err := cmd.Wait()
+		close(process.exited)
+		s.exit(connection, exitCodeOf(err))
+	}()
+	return process
+}
+
+// exit sends EOF and the exit status after all output and closes the channel
+func (s *Server) exit(connection ssh.Channel, exitCode int) {
+	connection.CloseWrite()
 	connection.SendRequest("exit-status", false, ssh.Marshal(exitStatusMsg{
 		Status: uint32(exitCode),
 	}))
 	connection.Close()
 }
 
-func (s *Server) handleSessionSubSystem(req *ssh.Request, connection ssh.Channel) {
+// exitCodeOf returns the exit code of the error of exec.Cmd.Wait()
+func exitCodeOf(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return 0
+}
+
+// startErrorExitCode returns the exit code of the error of exec.Cmd.Start() in the same way as shells
+func startErrorExitCode(err error) int {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return 127
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return 126
+	}
+	return 1
+}
+
+func (s *Server) handleSessionSubSystem(perms *permissions, req *ssh.Request, connection ssh.Channel) {
 	// https://github.com/pkg/sftp/blob/42e9800606febe03f9cdf1d1283719af4a5e6456/examples/go-sftp-server/main.go#L111
 	if string(req.Payload[4:]) != "sftp" {
 		req.Reply(false, nil)
 		return
 	}
-	if !s.AllowSftp {
+	if !perms.allowSftp {
 		s.Logger.Info("sftp not allowed")
 		req.Reply(false, nil)
 		return
 	}
+	// Only "internal-sftp" forced command allows SFTP in the same way as OpenSSH
+	if perms.forceCommand != "" && perms.forceCommand != "internal-sftp" {
+		s.Logger.Info("sftp not allowed because of forced command")
+		req.Reply(false, nil)
+		return
+	}
+
+	if perms.runAs != nil {
+		s.handleSftpHelper(perms, req, connection)
+		return
+	}
 
 	req.Reply(true, nil)
+	if err := serveSftp(connection); err != nil {
+		s.Logger.Info("failed to serve sftp server", "err", err)
+	}
+}
+
+// handleSftpHelper serves SFTP in the helper process running as the user
+func (s *Server) handleSftpHelper(perms *permissions, req *ssh.Request, connection ssh.Channel) {
+	if len(s.SftpHelperCommand) == 0 {
+		s.Logger.Info("sftp not allowed because no helper command is specified", "user", perms.runAs.name)
+		req.Reply(false, nil)
+		return
+	}
+	cmd := exec.Command(s.SftpHelperCommand[0], s.SftpHelperCommand[1:]...)
+	cmd.Env = perms.commandEnv("")
+	cmd.Dir = perms.workingDirectory()
+	cmd.Stdin = connection
+	cmd.Stdout = connection
+	cmd.Stderr = os.Stderr
+	if err := setCredential(cmd, perms.runAs); err != nil {
+		s.Logger.Info("failed to create sftp helper", "err", err)
+		req.Reply(false, nil)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		s.Logger.Info("failed to start sftp helper", "err", err)
+		req.Reply(false, nil)
+		return
+	}
+	req.Reply(true, nil)
+	if err := cmd.Wait(); err != nil {
+		s.Logger.Info("sftp helper exited", "err", err)
+	}
+	connection.Close()
+}
+
+// ServeSftp serves SFTP on r and w until EOF. It is for the helper process of Server.SftpHelperCommand.
+func ServeSftp(r io.Reader, w io.WriteCloser) error {
+	return serveSftp(struct {
+		io.Reader
+		io.WriteCloser
+	}{r, w})
+}
+
+func serveSftp(rwc io.ReadWriteCloser) error {
 	serverOptions := []sftp.ServerOption{
 		sftp.WithDebug(os.Stderr),
 	}
-	sftpServer, err := sftp.NewServer(connection, serverOptions...)
+	sftpServer, err := sftp.NewServer(rwc, serverOptions...)
 	if err != nil {
-		s.Logger.Info("failed to create sftp server", "err", err)
-		return
+		return err
 	}
 	if err := sftpServer.Serve(); err == io.EOF {
 		sftpServer.Close()
 	} else if err != nil {
-		s.Logger.Info("failed to serve sftp server", "err", err)
-		return
+		return err
 	}
+	return nil
 }
 
 // (base: https://github.com/peertechde/zodiac/blob/110fdd2dfd27359546c1cd75a9fec5de2882bf42/pkg/server/server.go#L228)
-func (s *Server) handleDirectTcpip(newChannel ssh.NewChannel) {
+func (s *Server) handleDirectTcpip(perms *permissions, newChannel ssh.NewChannel) {
 	var msg struct {
 		RemoteAddr string
 		RemotePort uint32
@@ -212,6 +511,11 @@ func (s *Server) handleDirectTcpip(newChannel ssh.NewChannel) {
 		s.Logger.Info("failed to parse direct-tcpip message", "err", err)
 		return
 	}
+	if !perms.permitsOpen(msg.RemoteAddr, msg.RemotePort) {
+		s.Logger.Info("direct-tcpip not permitted", "host", msg.RemoteAddr, "port", msg.RemotePort)
+		newChannel.Reject(ssh.Prohibited, "direct-tcpip to the address not permitted")
+		return
+	}
 	channel, reqs, err := newChannel.Accept()
 	if err != nil {
 		s.Logger.Info("failed to accept", "err", err)
@@ -286,56 +590,45 @@ func parseDims(b []byte) (uint32, uint32) {
 	return w, h
 }
 
-// ======================
-
-func GenerateKey() ([]byte, error) {
-	var r io.Reader
-	r = rand.Reader
-	priv, err := rsa.GenerateKey(r, 2048)
-	if err != nil {
-		return nil, err
-	}
-	err = priv.Validate()
-	if err != nil {
-		return nil, err
-	}
-	b := x509.MarshalPKCS1PrivateKey(priv)
-	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: b}), nil
-}
-
 // Borrowed from https://github.com/creack/termios/blob/master/win/win.go
 
 // ======================================================================
 
 func (s *Server) HandleGlobalRequests(sshConn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	perms := s.permissionsOf(sshConn)
+	go s.sendHostKeys(sshConn)
 	for req := range reqs {
 		switch req.Type {
+		case hostKeysProveRequestType:
+			go s.handleHostKeysProve(sshConn, req)
 		case "tcpip-forward":
-			if !s.AllowTcpipForward {
+			if !perms.allowTcpipForward {
 				s.Logger.Info("tcpip-forward not allowed")
 				req.Reply(false, nil)
 				break
 			}
-			go func() {
-				s.handleTcpipForward(sshConn, req)
-			}()
+			if perms.expired() {
+				s.Logger.Info("tcpip-forward not allowed because permissions expired")
+				req.Reply(false, nil)
+				break
+			}
+			go s.handleTcpipForward(perms, sshConn, req)
 		case "cancel-tcpip-forward":
-			go func() {
-				s.cancelTcpipForward(req)
-			}()
+			go s.cancelTcpipForward(req)
 		case "streamlocal-forward@openssh.com":
-			if !s.AllowStreamlocalForward {
+			if !perms.allowStreamlocalForward {
 				s.Logger.Info("streamlocal-forward not allowed")
 				req.Reply(false, nil)
 				break
 			}
-			go func() {
-				s.handleStreamlocalForward(sshConn, req)
-			}()
+			if perms.expired() {
+				s.Logger.Info("streamlocal-forward not allowed because permissions expired")
+				req.Reply(false, nil)
+				break
+			}
+			go s.handleStreamlocalForward(sshConn, req)
 		case "cancel-streamlocal-forward@openssh.com":
-			go func() {
-				s.cancelStreamlocalForward(req)
-			}()
+			go s.cancelStreamlocalForward(req)
 		default:
 			// discard
 			if req.WantReply {
@@ -347,7 +640,7 @@ func (s *Server) HandleGlobalRequests(sshConn *ssh.ServerConn, reqs <-chan *ssh.
 }
 
 // https://datatracker.ietf.org/doc/html/rfc4254#section-7.1
-func (s *Server) handleTcpipForward(sshConn *ssh.ServerConn, req *ssh.Request) {
+func (s *Server) handleTcpipForward(perms *permissions, sshConn *ssh.ServerConn, req *ssh.Request) {
 	var msg struct {
 		Addr string
 		Port uint32
@@ -356,6 +649,11 @@ func (s *Server) handleTcpipForward(sshConn *ssh.ServerConn, req *ssh.Request) {
 		req.Reply(false, nil)
 		return
 	}
+	if !perms.permitsListen(msg.Addr, msg.Port) {
+		s.Logger.Info("tcpip-forward not permitted", "host", msg.Addr, "port", msg.Port)
+		req.Reply(false, nil)
+		return
+	}
 	address := net.JoinHostPort(msg.Addr, strconv.Itoa(int(msg.Port)))
 	ln, err := net.Listen("tcp", address)
 	if err != nil {
@@ -0,0 +1,13 @@
+//go:build linux
+// +build linux
+
+package handy_sshd
+
+import "golang.org/x/sys/unix"
+
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+	// _POSIX_VDISABLE
+	posixVDisable = 0
+)
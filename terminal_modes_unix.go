@@ -0,0 +1,148 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package handy_sshd
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// Opcodes of terminal modes (RFC 4254 section 8) to indexes of control characters of termios
+var terminalModeControlChars = map[uint8]int{
+	ssh.VINTR:    unix.VINTR,
+	ssh.VQUIT:    unix.VQUIT,
+	ssh.VERASE:   unix.VERASE,
+	ssh.VKILL:    unix.VKILL,
+	ssh.VEOF:     unix.VEOF,
+	ssh.VEOL:     unix.VEOL,
+	ssh.VEOL2:    unix.VEOL2,
+	ssh.VSTART:   unix.VSTART,
+	ssh.VSTOP:    unix.VSTOP,
+	ssh.VSUSP:    unix.VSUSP,
+	ssh.VREPRINT: unix.VREPRINT,
+	ssh.VWERASE:  unix.VWERASE,
+	ssh.VLNEXT:   unix.VLNEXT,
+	ssh.VDISCARD: unix.VDISCARD,
+}
+
+// Opcodes of terminal modes to flags of termios
+var (
+	terminalModeInputFlags = map[uint8]uint64{
+		ssh.IGNPAR:  unix.IGNPAR,
+		ssh.PARMRK:  unix.PARMRK,
+		ssh.INPCK:   unix.INPCK,
+		ssh.ISTRIP:  unix.ISTRIP,
+		ssh.INLCR:   unix.INLCR,
+		ssh.IGNCR:   unix.IGNCR,
+		ssh.ICRNL:   unix.ICRNL,
+		ssh.IXON:    unix.IXON,
+		ssh.IXANY:   unix.IXANY,
+		ssh.IXOFF:   unix.IXOFF,
+		ssh.IMAXBEL: unix.IMAXBEL,
+	}
+	terminalModeLocalFlags = map[uint8]uint64{
+		ssh.ISIG:    unix.ISIG,
+		ssh.ICANON:  unix.ICANON,
+		ssh.ECHO:    unix.ECHO,
+		ssh.ECHOE:   unix.ECHOE,
+		ssh.ECHOK:   unix.ECHOK,
+		ssh.ECHONL:  unix.ECHONL,
+		ssh.NOFLSH:  unix.NOFLSH,
+		ssh.TOSTOP:  unix.TOSTOP,
+		ssh.IEXTEN:  unix.IEXTEN,
+		ssh.ECHOCTL: unix.ECHOCTL,
+		ssh.ECHOKE:  unix.ECHOKE,
+		ssh.PENDIN:  unix.PENDIN,
+	}
+	terminalModeOutputFlags = map[uint8]uint64{
+		ssh.OPOST:  unix.OPOST,
+		ssh.ONLCR:  unix.ONLCR,
+		ssh.OCRNL:  unix.OCRNL,
+		ssh.ONOCR:  unix.ONOCR,
+		ssh.ONLRET: unix.ONLRET,
+	}
+	terminalModeControlFlags = map[uint8]uint64{
+		ssh.PARENB: unix.PARENB,
+		ssh.PARODD: unix.PARODD,
+	}
+)
+
+const (
+	// TTY_OP_END
+	terminalModeEnd = 0
+	// The value of a disabled control character in terminal modes
+	terminalModeDisabledChar = 255
+)
+
+type terminalMode struct {
+	opcode uint8
+	value  uint32
+}
+
+// parseTerminalModes parses encoded terminal modes of "pty-req"
+func parseTerminalModes(modes string) ([]terminalMode, error) {
+	var result []terminalMode
+	b := []byte(modes)
+	for len(b) > 0 {
+		opcode := b[0]
+		// Opcodes 160 to 255 are not defined and stop parsing
+		if opcode == terminalModeEnd || opcode >= 160 {
+			break
+		}
+		if len(b) < 5 {
+			return nil, errors.New("truncated terminal modes")
+		}
+		result = append(result, terminalMode{opcode: opcode, value: binary.BigEndian.Uint32(b[1:5])})
+		b = b[5:]
+	}
+	return result, nil
+}
+
+// applyTerminalModes sets the terminal modes requested by the client to the tty. Unknown modes are ignored.
+func applyTerminalModes(tty *os.File, modes string) error {
+	parsed, err := parseTerminalModes(modes)
+	if err != nil || len(parsed) == 0 {
+		return err
+	}
+	termios, err := unix.IoctlGetTermios(int(tty.Fd()), ioctlGetTermios)
+	if err != nil {
+		return err
+	}
+	for _, mode := range parsed {
+		on := mode.value != 0
+		if index, ok := terminalModeControlChars[mode.opcode]; ok {
+			c := uint8(mode.value)
+			if mode.value == terminalModeDisabledChar {
+				c = posixVDisable
+			}
+			termios.Cc[index] = c
+		} else if flag, ok := terminalModeInputFlags[mode.opcode]; ok {
+			termios.Iflag = setTermiosFlag(termios.Iflag, flag, on)
+		} else if flag, ok := terminalModeLocalFlags[mode.opcode]; ok {
+			termios.Lflag = setTermiosFlag(termios.Lflag, flag, on)
+		} else if flag, ok := terminalModeOutputFlags[mode.opcode]; ok {
+			termios.Oflag = setTermiosFlag(termios.Oflag, flag, on)
+		} else if flag, ok := terminalModeControlFlags[mode.opcode]; ok {
+			termios.Cflag = setTermiosFlag(termios.Cflag, flag, on)
+		} else if (mode.opcode == ssh.CS7 || mode.opcode == ssh.CS8) && on {
+			size := uint64(unix.CS7)
+			if mode.opcode == ssh.CS8 {
+				size = unix.CS8
+			}
+			termios.Cflag = setTermiosFlag(setTermiosFlag(termios.Cflag, unix.CSIZE, false), size, true)
+		}
+	}
+	return unix.IoctlSetTermios(int(tty.Fd()), ioctlSetTermios, termios)
+}
+
+// setTermiosFlag sets or clears the flag. Types of the flags of termios depend on the OS.
+func setTermiosFlag[T uint32 | uint64](flags T, flag uint64, on bool) T {
+	if on {
+		return flags | T(flag)
+	}
+	return flags &^ T(flag)
+}
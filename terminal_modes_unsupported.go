@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package handy_sshd
+
+import "os"
+
+// applyTerminalModes does nothing. The defaults of the pty are used.
+func applyTerminalModes(tty *os.File, modes string) error {
+	return nil
+}
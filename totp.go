@@ -0,0 +1,62 @@
+package handy_sshd
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// TOTP parameters compatible with common authenticator apps (RFC 6238 with HMAC-SHA1)
+const (
+	TotpDigits = 6
+	TotpPeriod = 30 * time.Second
+	// Steps of clock skew accepted before and after the current step
+	totpSkew = 1
+)
+
+// ParseTotpSecret decodes a base32 TOTP secret. Spaces, lower case and missing padding are accepted.
+func ParseTotpSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	secret = strings.TrimRight(secret, "=")
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid TOTP secret")
+	}
+	if len(key) == 0 {
+		return nil, errors.New("empty TOTP secret")
+	}
+	return key, nil
+}
+
+// TotpCode returns the TOTP code of the time step
+func TotpCode(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TotpDigits, value%1000000)
+}
+
+// TotpStep returns the time step of t
+func TotpStep(t time.Time) int64 {
+	return t.Unix() / int64(TotpPeriod/time.Second)
+}
+
+// VerifyTotp verifies the code at t allowing one step of clock skew. The matched step is returned so that callers can reject reuse of the code.
+func VerifyTotp(key []byte, code string, t time.Time) (step int64, ok bool) {
+	code = strings.TrimSpace(code)
+	current := TotpStep(t)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(TotpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,477 @@
+package handy_sshd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+	"math/bits"
+	"strings"
+)
+
+// Implementation of yescrypt ($y$), the default in /etc/shadow of recent Debian, Ubuntu and Fedora.
+// Only the default flavor without ROM is supported, which libxcrypt uses.
+// (ref: https://github.com/openwall/yescrypt/blob/main/yescrypt-ref.c)
+
+const yescryptPrefix = "$y$"
+
+const (
+	yescryptRW = 0x002
+	// YESCRYPT_RW | YESCRYPT_ROUNDS_6 | YESCRYPT_GATHER_4 | YESCRYPT_SIMPLE_2 | YESCRYPT_SBOX_12K
+	yescryptDefaults = 0x0b6
+	// Max memory of V not to be exhausted by a hash with a huge cost
+	yescryptMaxMemory = 1 << 30
+
+	pwxSimple      = 2
+	pwxGather      = 4
+	pwxRounds      = 6
+	yescryptSwidth = 8
+	pwxWords       = pwxGather * pwxSimple * 2
+	// Words of each of S0, S1 and S2
+	yescryptSWords = (1 << yescryptSwidth) * pwxSimple * 2
+	// Mask of byte offsets in S0 and S1
+	yescryptSMask = ((1 << yescryptSwidth) - 1) * pwxSimple * 8
+)
+
+type yescryptParams struct {
+	n uint64
+	r uint32
+	p uint32
+	t uint32
+}
+
+// yescrypt hashes the password with the setting (e.g. "$y$j9T$salt" or a whole hash, whose hash part is ignored)
+func yescrypt(password []byte, setting string) (string, error) {
+	if !strings.HasPrefix(setting, yescryptPrefix) {
+		return "", errors.Errorf("not %s hash", yescryptPrefix)
+	}
+	parts := strings.Split(setting[len(yescryptPrefix):], "$")
+	if len(parts) < 2 {
+		return "", errors.New("no salt")
+	}
+	params, err := parseYescryptParams(parts[0])
+	if err != nil {
+		return "", err
+	}
+	salt, err := decodeYescrypt64(parts[1])
+	if err != nil {
+		return "", err
+	}
+	key := yescryptKdf(password, salt, params)
+	var encoded strings.Builder
+	for i := 0; i < len(key); i += 3 {
+		var w uint32
+		n := 0
+		for j := i; j < i+3 && j < len(key); j++ {
+			w |= uint32(key[j]) << (8 * (j - i))
+			n += 8
+		}
+		encoded.WriteString(encodeCrypt64(w, (n+5)/6))
+	}
+	return yescryptPrefix + parts[0] + "$" + parts[1] + "$" + encoded.String(), nil
+}
+
+// parseYescryptParams parses the parameters encoded by yescrypt_encode_params_r() (e.g. "j9T")
+func parseYescryptParams(s string) (*yescryptParams, error) {
+	flavor, s, err := decodeYescryptUint32(s, 0)
+	if err != nil {
+		return nil, err
+	}
+	if flavor < yescryptRW || yescryptRW+((flavor-yescryptRW)<<2) != yescryptDefaults {
+		return nil, errors.New("unsupported yescrypt flavor")
+	}
+	nLog2, s, err := decodeYescryptUint32(s, 1)
+	if err != nil {
+		return nil, err
+	}
+	params := &yescryptParams{p: 1}
+	params.r, s, err = decodeYescryptUint32(s, 1)
+	if err != nil {
+		return nil, err
+	}
+	if s != "" {
+		var have uint32
+		have, s, err = decodeYescryptUint32(s, 1)
+		if err != nil {
+			return nil, err
+		}
+		if have&1 != 0 {
+			if params.p, s, err = decodeYescryptUint32(s, 2); err != nil {
+				return nil, err
+			}
+		}
+		if have&2 != 0 {
+			if params.t, s, err = decodeYescryptUint32(s, 1); err != nil {
+				return nil, err
+			}
+		}
+		// Upgrades (g) and ROM are not supported
+		if have&^3 != 0 {
+			return nil, errors.New("unsupported yescrypt parameters")
+		}
+	}
+	if s != "" {
+		return nil, errors.New("invalid yescrypt parameters")
+	}
+	if nLog2 < 1 || nLog2 > 32 {
+		return nil, errors.Errorf("invalid yescrypt N: 2^%d", nLog2)
+	}
+	params.n = 1 << nLog2
+	if params.n/uint64(params.p) < 2 || uint64(params.r)*params.n*128 > yescryptMaxMemory {
+		return nil, errors.New("unsupported yescrypt cost")
+	}
+	return params, nil
+}
+
+// decodeYescryptUint32 decodes a variable-length integer in the same way as decode64_uint32() of yescrypt
+func decodeYescryptUint32(s string, min uint32) (uint32, string, error) {
+	if s == "" {
+		return 0, "", errors.New("invalid yescrypt parameters")
+	}
+	c := strings.IndexByte(cryptAlphabet, s[0])
+	if c < 0 {
+		return 0, "", errors.New("invalid yescrypt parameters")
+	}
+	s = s[1:]
+	value := uint64(min)
+	start, end, chars, shift := uint64(0), uint64(47), 1, 0
+	for uint64(c) > end {
+		value += (end + 1 - start) << shift
+		start = end + 1
+		end = start + (62-end)/2
+		chars++
+		shift += 6
+	}
+	value += (uint64(c) - start) << shift
+	for ; chars > 1; chars-- {
+		if s == "" {
+			return 0, "", errors.New("invalid yescrypt parameters")
+		}
+		c := strings.IndexByte(cryptAlphabet, s[0])
+		if c < 0 {
+			return 0, "", errors.New("invalid yescrypt parameters")
+		}
+		s = s[1:]
+		value += uint64(c) << shift
+		shift += 6
+	}
+	if value > 0xffffffff {
+		return 0, "", errors.New("invalid yescrypt parameters")
+	}
+	return uint32(value), s, nil
+}
+
+// decodeYescrypt64 decodes the salt encoded in little-endian groups of 4 characters
+func decodeYescrypt64(s string) ([]byte, error) {
+	var result []byte
+	for len(s) > 0 {
+		n := 4
+		if len(s) < n {
+			n = len(s)
+		}
+		if n == 1 {
+			return nil, errors.New("invalid yescrypt salt")
+		}
+		var w uint32
+		for i := 0; i < n; i++ {
+			c := strings.IndexByte(cryptAlphabet, s[i])
+			if c < 0 {
+				return nil, errors.New("invalid yescrypt salt")
+			}
+			w |= uint32(c) << (6 * i)
+		}
+		s = s[n:]
+		bytes := n * 6 / 8
+		if w>>(8*bytes) != 0 {
+			return nil, errors.New("invalid yescrypt salt")
+		}
+		for i := 0; i < bytes; i++ {
+			result = append(result, byte(w>>(8*i)))
+		}
+	}
+	return result, nil
+}
+
+// yescryptKdf derives a 32-byte key as yescrypt_kdf() does
+func yescryptKdf(password []byte, salt []byte, params *yescryptParams) []byte {
+	// Pre-hashing with 1/64 of the memory
+	if params.n/uint64(params.p) >= 0x100 && params.n/uint64(params.p)*uint64(params.r) >= 0x20000 {
+		password = yescryptKdfBody(password, salt, params.n>>6, params.r, params.p, 0, true)
+	}
+	return yescryptKdfBody(password, salt, params.n, params.r, params.p, params.t, false)
+}
+
+func yescryptKdfBody(password []byte, salt []byte, n uint64, r uint32, p uint32, t uint32, prehash bool) []byte {
+	hmacKey := "yescrypt"
+	if prehash {
+		hmacKey = "yescrypt-prehash"
+	}
+	mac := hmac.New(sha256.New, []byte(hmacKey))
+	mac.Write(password)
+	password = mac.Sum(nil)
+
+	b := pbkdf2.Key(password, salt, 1, 128*int(r)*int(p), sha256.New)
+	password = append([]byte{}, b[:32]...)
+	B := make([]uint32, len(b)/4)
+	for i := range B {
+		B[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	password = yescryptSmix(B, int(r), n, p, t, password)
+	for i, w := range B {
+		binary.LittleEndian.PutUint32(b[i*4:], w)
+	}
+
+	key := pbkdf2.Key(password, b, 1, 32, sha256.New)
+	if prehash {
+		return key
+	}
+	// ClientKey and StoredKey of SCRAM (RFC 5802)
+	mac = hmac.New(sha256.New, key)
+	mac.Write([]byte("Client Key"))
+	storedKey := sha256.Sum256(mac.Sum(nil))
+	return storedKey[:]
+}
+
+type pwxformContext struct {
+	s0, s1, s2 []uint32
+	w          int
+}
+
+// yescryptSmix returns the password updated with HMAC-SHA256
+func yescryptSmix(B []uint32, r int, n uint64, p uint32, t uint32, password []byte) []byte {
+	s := 32 * r
+	V := make([]uint32, uint64(s)*n)
+	XY := make([]uint32, 2*s)
+	S := make([]uint32, 3*yescryptSWords*int(p))
+
+	nChunk := n / uint64(p)
+	nLoopAll := nChunk
+	if t <= 1 {
+		if t == 1 {
+			nLoopAll *= 2
+		}
+		nLoopAll = (nLoopAll + 2) / 3
+	} else {
+		nLoopAll *= uint64(t) - 1
+	}
+	nLoopRW := nLoopAll / uint64(p)
+	nChunk &^= 1
+	nLoopAll = (nLoopAll + 1) &^ 1
+	nLoopRW = (nLoopRW + 1) &^ 1
+
+	contexts := make([]*pwxformContext, p)
+	var vChunk uint64
+	for i := 0; i < int(p); i++ {
+		np := nChunk
+		if i == int(p)-1 {
+			np = n - vChunk
+		}
+		Bp := B[s*i : s*(i+1)]
+		Vp := V[uint64(s)*vChunk:]
+		Si := S[3*yescryptSWords*i : 3*yescryptSWords*(i+1)]
+		// S-boxes are initialized with 1-block smix1
+		yescryptSmix1(Bp, 1, 3*yescryptSWords/32, false, Si, XY, nil)
+		contexts[i] = &pwxformContext{s2: Si[:yescryptSWords], s1: Si[yescryptSWords : 2*yescryptSWords], s0: Si[2*yescryptSWords:]}
+		if i == 0 {
+			last := make([]byte, 64)
+			for k, w := range Bp[s-16:] {
+				binary.LittleEndian.PutUint32(last[k*4:], w)
+			}
+			mac := hmac.New(sha256.New, last)
+			mac.Write(password)
+			password = mac.Sum(nil)
+		}
+		yescryptSmix1(Bp, r, np, true, Vp, XY, contexts[i])
+		yescryptSmix2(Bp, r, p2floor(np), nLoopRW, true, Vp, XY, contexts[i])
+		vChunk += nChunk
+	}
+	for i := 0; i < int(p); i++ {
+		yescryptSmix2(B[s*i:s*(i+1)], r, n, nLoopAll-nLoopRW, false, V, XY, contexts[i])
+	}
+	return password
+}
+
+func yescryptSmix1(B []uint32, r int, n uint64, rw bool, V []uint32, XY []uint32, ctx *pwxformContext) {
+	s := 32 * r
+	X := XY[:s]
+	Y := XY[s : 2*s]
+	shuffle(X, B, r)
+	for i := uint64(0); i < n; i++ {
+		copy(V[i*uint64(s):], X)
+		if rw && i > 1 {
+			j := wrap(integerify(X, r), i)
+			xorWords(X, V[j*uint64(s):(j+1)*uint64(s)])
+		}
+		if ctx != nil {
+			blockmixPwxform(X, ctx, r)
+		} else {
+			blockmixSalsa8(X, Y, r)
+		}
+	}
+	unshuffle(B, X, r)
+}
+
+func yescryptSmix2(B []uint32, r int, n uint64, nLoop uint64, rw bool, V []uint32, XY []uint32, ctx *pwxformContext) {
+	if nLoop == 0 {
+		return
+	}
+	s := 32 * r
+	X := XY[:s]
+	Y := XY[s : 2*s]
+	shuffle(X, B, r)
+	for i := uint64(0); i < nLoop; i++ {
+		j := integerify(X, r) & (n - 1)
+		Vj := V[j*uint64(s) : (j+1)*uint64(s)]
+		xorWords(X, Vj)
+		if rw {
+			copy(Vj, X)
+		}
+		if ctx != nil {
+			blockmixPwxform(X, ctx, r)
+		} else {
+			blockmixSalsa8(X, Y, r)
+		}
+	}
+	unshuffle(B, X, r)
+}
+
+// shuffle reorders words of each 64-byte block into the order of the reference implementation (SIMD shuffle)
+func shuffle(X []uint32, B []uint32, r int) {
+	for k := 0; k < 2*r; k++ {
+		for i := 0; i < 16; i++ {
+			X[k*16+i] = B[k*16+(i*5%16)]
+		}
+	}
+}
+
+func unshuffle(B []uint32, X []uint32, r int) {
+	for k := 0; k < 2*r; k++ {
+		for i := 0; i < 16; i++ {
+			B[k*16+(i*5%16)] = X[k*16+i]
+		}
+	}
+}
+
+// integerify returns the first 64 bits of the last 64-byte block of the shuffled X
+func integerify(X []uint32, r int) uint64 {
+	last := X[(2*r-1)*16:]
+	return uint64(last[13])<<32 | uint64(last[0])
+}
+
+func wrap(x uint64, i uint64) uint64 {
+	n := p2floor(i)
+	return (x & (n - 1)) + (i - n)
+}
+
+// p2floor returns the largest power of 2 not greater than x
+func p2floor(x uint64) uint64 {
+	return 1 << (63 - bits.LeadingZeros64(x))
+}
+
+func xorWords(dst []uint32, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+func blockmixSalsa8(B []uint32, Y []uint32, r int) {
+	var X [16]uint32
+	copy(X[:], B[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		xorWords(X[:], B[i*16:(i+1)*16])
+		salsa20(X[:], 8)
+		copy(Y[i*16:], X[:])
+	}
+	for i := 0; i < r; i++ {
+		copy(B[i*16:(i+1)*16], Y[(i*2)*16:])
+		copy(B[(i+r)*16:(i+r+1)*16], Y[(i*2+1)*16:])
+	}
+}
+
+func blockmixPwxform(B []uint32, ctx *pwxformContext, r int) {
+	var X [pwxWords]uint32
+	r1 := 2 * r
+	copy(X[:], B[(r1-1)*pwxWords:])
+	for i := 0; i < r1; i++ {
+		if r1 > 1 {
+			xorWords(X[:], B[i*pwxWords:(i+1)*pwxWords])
+		}
+		pwxform(X[:], ctx)
+		copy(B[i*pwxWords:], X[:])
+	}
+	salsa20(B[(r1-1)*16:r1*16], 2)
+}
+
+func pwxform(X []uint32, ctx *pwxformContext) {
+	s0, s1, s2 := ctx.s0, ctx.s1, ctx.s2
+	w := ctx.w
+	for i := 0; i < pwxRounds; i++ {
+		for j := 0; j < pwxGather; j++ {
+			lane := X[j*pwxSimple*2 : (j+1)*pwxSimple*2]
+			p0 := s0[(lane[0]&yescryptSMask)/4:]
+			p1 := s1[(lane[1]&yescryptSMask)/4:]
+			for k := 0; k < pwxSimple; k++ {
+				x := uint64(lane[2*k+1]) * uint64(lane[2*k])
+				x += uint64(p0[2*k+1])<<32 | uint64(p0[2*k])
+				x ^= uint64(p1[2*k+1])<<32 | uint64(p1[2*k])
+				lane[2*k] = uint32(x)
+				lane[2*k+1] = uint32(x >> 32)
+				if i != 0 && i != pwxRounds-1 {
+					s2[2*w] = uint32(x)
+					s2[2*w+1] = uint32(x >> 32)
+					w++
+				}
+			}
+		}
+	}
+	ctx.s0, ctx.s1, ctx.s2 = s2, s0, s1
+	ctx.w = w & (yescryptSWords/2 - 1)
+}
+
+// salsa20 applies the Salsa20 core to the shuffled block
+func salsa20(B []uint32, rounds int) {
+	var x [16]uint32
+	for i := 0; i < 16; i++ {
+		x[i*5%16] = B[i]
+	}
+	for i := 0; i < rounds; i += 2 {
+		// Columns
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+		// Rows
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := 0; i < 16; i++ {
+		B[i] += x[i*5%16]
+	}
+}